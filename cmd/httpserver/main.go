@@ -1,106 +1,166 @@
 package main
 
 import (
+    "context"
+    "crypto/rand"
     "crypto/sha256"
+    "encoding/hex"
+    "flag"
     "fmt"
     "io"
     "log"
     "net/http"
     "os"
     "os/signal"
+    "strconv"
     "strings"
     "syscall"
+    "time"
 
+    "github.com/mrtuuro/http-from-tcp/internal/fileserver"
     "github.com/mrtuuro/http-from-tcp/internal/headers"
     "github.com/mrtuuro/http-from-tcp/internal/request"
     "github.com/mrtuuro/http-from-tcp/internal/response"
+    "github.com/mrtuuro/http-from-tcp/internal/router"
     "github.com/mrtuuro/http-from-tcp/internal/server"
 )
 
 const port = 42069
 
+// maxDecodedBodyBytes caps compressed uploads once decompressed
+const maxDecodedBodyBytes = 1 << 30
+
 func main() {
-    server, err := server.Serve(port, ServerHandler)
+    addr := flag.String("addr", fmt.Sprintf(":%d", port), "address to listen on: host:port, unix:/path/to/socket or systemd:")
+    socketMode := flag.String("socket-mode", "0600", "permissions of a unix: socket, in octal")
+    flag.Parse()
+    mode, err := strconv.ParseUint(*socketMode, 8, 32)
+    if err != nil || mode > 0o777 {
+        log.Fatalf("Invalid -socket-mode: %q", *socketMode)
+    }
+
+    server, err := server.ServeAddr(*addr, server.Chain(requestID, logRequests, server.Compress(response.Compression{}), server.DecodeRequests(maxDecodedBodyBytes))(ServerHandler()), server.Options{
+        ReadHeaderTimeout: 10 * time.Second,
+        IdleTimeout:       60 * time.Second,
+        UnixSocketMode:    os.FileMode(mode),
+    })
     if err != nil {
         log.Fatalf("Error starting server: %v", err)
     }
-    defer server.Close()
-    log.Println("Server started on port", port)
+    log.Println("Server started on", *addr)
 
     sigChan := make(chan os.Signal, 1)
     signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
     <-sigChan
+
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+    if err := server.Shutdown(ctx); err != nil {
+        log.Printf("Error shutting down: %v", err)
+    }
     log.Println("Server gravefully stopped")
 }
 
-func ServerHandler(w *response.Writer, req *request.Request) {
-    if req.RequestLine.RequestTarget == "/upload" {
-        uploadHandler(w, req)
-    }
-    if req.RequestLine.RequestTarget == "/video" {
-        videoHandler(w, req)
-    }
-    if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
-        proxyHandler(w, req)
-        return
+func ServerHandler() server.Handler {
+    r := router.New()
+    r.Get("/", handler200)
+    r.Post("/upload", uploadHandler)
+    r.Get("/video", videoHandler)
+    r.Get("/httpbin/{path...}", proxyHandler)
+    r.Get("/yourproblem", handler400)
+    r.Get("/myproblem", handler500)
+
+    assets, err := fileserver.Dir("assets", fileserver.Options{Prefix: "/assets", ListDirectories: true})
+    if err != nil {
+        log.Printf("Not serving /assets: %v", err)
+    } else {
+        r.Get("/assets/{path...}", assets)
     }
-    if req.RequestLine.RequestTarget == "/yourproblem" {
-        handler200(w, req)
-        return
+    return r.Serve
+}
+
+type requestIDKey struct{}
+
+// requestID tags every response with an X-Request-ID, reusing the one the
+// client sent if any, and stores it in the request context
+func requestID(next server.Handler) server.Handler {
+    return func(w *response.Writer, req *request.Request) {
+        id, found := req.Headers.Get("X-Request-ID")
+        if !found {
+            b := make([]byte, 8)
+            rand.Read(b)
+            id = hex.EncodeToString(b)
+        }
+        w.Header().Set("X-Request-ID", id)
+        next(w, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
     }
-    if req.RequestLine.RequestTarget == "/myproblem" {
-        handler500(w, req)
-        return
+}
+
+func logRequests(next server.Handler) server.Handler {
+    return func(w *response.Writer, req *request.Request) {
+        start := time.Now()
+        next(w, req)
+        id, _ := req.Context().Value(requestIDKey{}).(string)
+        log.Printf("[%s] %s %s %d %dB %s", id, req.RequestLine.Method, req.RequestLine.RequestTarget,
+            w.StatusCode(), w.BytesWritten(), time.Since(start))
     }
-    handler200(w, req)
-    return
 }
 
 func uploadHandler(w *response.Writer, req *request.Request) {
     filePath := "test.mp4"
 
-    bufferSize := 1024
-    idx := 0
-
-    reqData := req.Body
-    for idx <= len(reqData) {
-        err := os.WriteFile(filePath, reqData[:bufferSize], 0644)
-        if err != nil {
-            handler500(w, req)
-        }
+    f, err := os.Create(filePath)
+    if err != nil {
+        handler500(w, req)
+        return
     }
+    defer f.Close()
 
-    w.WriteStatusLine(response.StatusOK)
-    h := response.GetDefaultHeaders(len(reqData))
-    h.Override("Content-Type", "text/plain")
-    fmt.Println(h)
-    w.WriteHeaders(h)
-    w.WriteBody([]byte("Downloaded successfuly!"))
+    // NOTE: stream the upload straight to disk instead of holding it in memory
+    n, err := io.Copy(f, req.Body)
+    if err != nil {
+        handler500(w, req)
+        return
+    }
 
+    // NOTE: the writer picks Content-Length itself for short bodies
+    w.Header().Set("Content-Type", "text/plain")
+    fmt.Fprintf(w, "Uploaded %d bytes successfully!", n)
 }
 
 func videoHandler(w *response.Writer, req *request.Request) {
     const videoPath = "assets/vim.mp4"
-    fmt.Println(os.Getwd())
-    reqData, err := os.ReadFile(videoPath)
+    f, err := os.Open(videoPath)
     if err != nil {
         handler500(w, req)
+        return
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil {
+        handler500(w, req)
+        return
+    }
+    // NOTE: streamed from disk, the video is never held in memory whole
+    w.Header().Set("Content-Type", "video/mp4")
+    w.Header().Set("ETag", response.FileETag(info.ModTime(), info.Size()))
+    if err := response.ServeContent(w, req, info.Name(), info.ModTime(), f); err != nil {
+        log.Printf("Error serving %s: %v", videoPath, err)
     }
-    w.WriteStatusLine(response.StatusOK)
-    h := response.GetDefaultHeaders(len(reqData))
-    h.Override("Content-Type", "video/mp4")
-    fmt.Println(h)
-    w.WriteHeaders(h)
-    w.WriteBody(reqData)
-
 }
 
-
 func proxyHandler(w *response.Writer, req *request.Request) {
     target := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
     url := "https://httpbin.org/" + target
     fmt.Println("Proxying to", url)
-    resp, err := http.Get(url)
+    // NOTE: tie the upstream call to the request so it stops when the
+    // client goes away
+    upstreamReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, url, nil)
+    if err != nil {
+        handler500(w, req)
+        return
+    }
+    resp, err := http.DefaultClient.Do(upstreamReq)
     if err != nil {
         handler500(w, req)
         return
@@ -109,9 +169,8 @@ func proxyHandler(w *response.Writer, req *request.Request) {
 
     w.WriteStatusLine(response.StatusOK)
     h := response.GetDefaultHeaders(0)
-    h.Override("Transfer-Encoding", "chunked")
-    h.Set("Trailers", "X-Content-SHA256")
-    h.Override("Trailer", "X-Content-SHA256, X-Content-Length")
+    h.Set("Transfer-Encoding", "chunked")
+    h.Set("Trailer", "X-Content-SHA256, X-Content-Length")
     h.Del("Content-Length")
     w.WriteHeaders(h)
 
@@ -137,18 +196,14 @@ func proxyHandler(w *response.Writer, req *request.Request) {
             break
         }
     }
-    _, err = w.WriteChunkedBodyDone()
-    if err != nil {
-        fmt.Println("Error writing chunked body done:", err)
-    }
-
+    // NOTE: WriteTrailers writes the last chunk and ends the response
     trailers := headers.NewHeaders()
     sha256 := fmt.Sprintf("%x", sha256.Sum256(fullBody))
-    trailers.Override("X-Content-SHA256", sha256)
-    trailers.Override("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
+    trailers.Set("X-Content-SHA256", sha256)
+    trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(fullBody)))
     err = w.WriteTrailers(trailers)
     if err != nil {
-        fmt.Println("Error writing chunked body done:", err)
+        fmt.Println("Error writing trailers:", err)
     }
 }
 
@@ -165,7 +220,7 @@ func handler400(w *response.Writer, _ *request.Request) {
     </html>
     `)
     h := response.GetDefaultHeaders(len(body))
-    h.Override("Content-Type", "text/html")
+    h.Set("Content-Type", "text/html")
     w.WriteHeaders(h)
     w.WriteBody(body)
     return
@@ -184,13 +239,12 @@ func handler500(w *response.Writer, _ *request.Request) {
     </html>
     `)
     h := response.GetDefaultHeaders(len(body))
-    h.Override("Content-Type", "text/html")
+    h.Set("Content-Type", "text/html")
     w.WriteHeaders(h)
     w.WriteBody(body)
 }
 
-func handler200(w *response.Writer, _ *request.Request) {
-    w.WriteStatusLine(response.StatusOK)
+func handler200(w *response.Writer, req *request.Request) {
     body := []byte(`<html>
     <head>
     <title>200 OK</title>
@@ -201,8 +255,13 @@ func handler200(w *response.Writer, _ *request.Request) {
     </body>
     </html>
     `)
+    w.Header().Set("ETag", response.ContentETag(body))
+    if response.CheckPreconditions(w, req, time.Time{}) {
+        return
+    }
+    w.WriteStatusLine(response.StatusOK)
     h := response.GetDefaultHeaders(len(body))
-    h.Override("Content-Type", "text/html")
+    h.Set("Content-Type", "text/html")
     w.WriteHeaders(h)
     w.WriteBody(body)
     return
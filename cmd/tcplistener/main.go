@@ -2,8 +2,10 @@ package main
 
 import (
     "fmt"
+    "io"
     "log"
     "net"
+    "os"
 
     "github.com/mrtuuro/http-from-tcp/internal/request"
 )
@@ -35,11 +37,11 @@ func main() {
         fmt.Printf("- Target: %s\n", req.RequestLine.RequestTarget)
         fmt.Printf("- Version: %s\n", req.RequestLine.HttpVersion)
         fmt.Println("Headers:")
-        for key, val := range req.Headers {
+        req.Headers.Range(func(key, val string) bool {
             fmt.Printf("- %s: %s\n", key, val)
-
-        }
+            return true
+        })
         fmt.Printf("Body:\n")
-        fmt.Printf("%s", string(req.Body))
+        io.Copy(os.Stdout, req.Body)
     }
 }
@@ -0,0 +1,332 @@
+package adapter
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+
+    "github.com/mrtuuro/http-from-tcp/internal/headers"
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+    "github.com/mrtuuro/http-from-tcp/internal/response"
+    "github.com/mrtuuro/http-from-tcp/internal/server"
+)
+
+// FromHTTP runs a net/http handler as a server.Handler. The
+// http.ResponseWriter it gets writes through response.Writer, with its
+// automatic framing, and implements http.Flusher and http.Hijacker.
+// Trailers declared in the Trailer header are sent once the handler
+// returns.
+func FromHTTP(h http.Handler) server.Handler {
+    return func(w *response.Writer, req *request.Request) {
+        hreq, err := newHTTPRequest(req)
+        if err != nil {
+            response.WriteStatus(w, response.StatusBadRequest, nil)
+            return
+        }
+        rw := &responseWriter{w: w, header: http.Header{}}
+        h.ServeHTTP(rw, hreq)
+        if rw.hijacked {
+            return
+        }
+        rw.finish()
+    }
+}
+
+// newHTTPRequest builds the net/http view of req, sharing its body
+func newHTTPRequest(req *request.Request) (*http.Request, error) {
+    target := req.RequestLine.RequestTarget
+    var u *url.URL
+    var err error
+    if req.RequestLine.Method == "CONNECT" && !strings.HasPrefix(target, "/") {
+        u = &url.URL{Host: target}
+    } else if u, err = url.ParseRequestURI(target); err != nil {
+        return nil, err
+    }
+    major, minor, ok := http.ParseHTTPVersion("HTTP/" + req.RequestLine.HttpVersion)
+    if !ok {
+        return nil, fmt.Errorf("invalid HTTP version: %s", req.RequestLine.HttpVersion)
+    }
+
+    hreq := &http.Request{
+        Method:     req.RequestLine.Method,
+        URL:        u,
+        Proto:      "HTTP/" + req.RequestLine.HttpVersion,
+        ProtoMajor: major,
+        ProtoMinor: minor,
+        Header:     http.Header{},
+        Body:       http.NoBody,
+        Host:       u.Host,
+        RemoteAddr: req.RemoteAddr,
+        RequestURI: target,
+        TLS:        req.TLS,
+    }
+    req.Headers.Range(func(k, v string) bool {
+        hreq.Header.Add(k, v)
+        return true
+    })
+    // NOTE: net/http keeps Host and Transfer-Encoding out of Header
+    if host := hreq.Header.Get("Host"); host != "" && hreq.Host == "" {
+        hreq.Host = host
+    }
+    hreq.Header.Del("Host")
+    if te := hreq.Header.Get("Transfer-Encoding"); te != "" {
+        hreq.TransferEncoding = []string{"chunked"}
+        hreq.Header.Del("Transfer-Encoding")
+    }
+
+    if req.Body != request.NoBody {
+        hreq.Body = req.Body
+        hreq.ContentLength = -1
+        if cl, err := strconv.ParseInt(hreq.Header.Get("Content-Length"), 10, 64); err == nil {
+            hreq.ContentLength = cl
+        }
+    }
+    // NOTE: like net/http, Trailer starts out with the announced names and
+    // gets the values once the body has been read to the end
+    if hreq.TransferEncoding != nil && req.Body != request.NoBody {
+        hreq.Trailer = http.Header{}
+        for _, list := range hreq.Header.Values("Trailer") {
+            for _, k := range strings.Split(list, ",") {
+                if k = strings.TrimSpace(k); k != "" {
+                    hreq.Trailer[http.CanonicalHeaderKey(k)] = nil
+                }
+            }
+        }
+        hreq.Header.Del("Trailer")
+        hreq.Body = &trailerBody{ReadCloser: req.Body, src: req.Trailers, dst: hreq.Trailer}
+    }
+    return hreq.WithContext(req.Context()), nil
+}
+
+// trailerBody copies the trailers of a chunked body into an http.Header
+// when the body is done
+type trailerBody struct {
+    io.ReadCloser
+    src    *headers.Headers
+    dst    http.Header
+    copied bool
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+    n, err := b.ReadCloser.Read(p)
+    if err == io.EOF && !b.copied {
+        b.copied = true
+        b.src.Range(func(k, v string) bool {
+            b.dst.Add(k, v)
+            return true
+        })
+    }
+    return n, err
+}
+
+// responseWriter is the http.ResponseWriter handed to net/http handlers
+type responseWriter struct {
+    w           *response.Writer
+    header      http.Header
+    wroteHeader bool
+    hijacked    bool
+}
+
+func (rw *responseWriter) Header() http.Header {
+    return rw.header
+}
+
+// WriteHeader copies the header over, later changes to it only matter for
+// trailers, like with net/http
+func (rw *responseWriter) WriteHeader(code int) {
+    if rw.wroteHeader || rw.hijacked {
+        return
+    }
+    if code < 100 || code > 999 {
+        panic(fmt.Sprintf("invalid WriteHeader code %v", code))
+    }
+    // NOTE: response.Writer has no interim responses, the final status
+    // follows anyway
+    if code < 200 && code != http.StatusSwitchingProtocols {
+        return
+    }
+    rw.wroteHeader = true
+    // NOTE: the handler's fields replace ones set earlier, e.g. by a
+    // middleware, rather than being sent next to them
+    for k, values := range rw.header {
+        rw.w.Header().Del(k)
+        for _, v := range values {
+            rw.w.Header().Add(k, v)
+        }
+    }
+    // NOTE: trailers can only follow a chunked body
+    if _, found := rw.header["Trailer"]; found {
+        rw.w.Header().Set("Transfer-Encoding", "chunked")
+        rw.w.Header().Del("Content-Length")
+    }
+    rw.w.WriteHeader(response.StatusCode(code))
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+    if rw.hijacked {
+        return 0, http.ErrHijacked
+    }
+    rw.WriteHeader(http.StatusOK)
+    return rw.w.Write(p)
+}
+
+func (rw *responseWriter) Flush() {
+    if rw.hijacked {
+        return
+    }
+    rw.WriteHeader(http.StatusOK)
+    rw.w.Flush()
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    if rw.hijacked {
+        return nil, nil, http.ErrHijacked
+    }
+    conn, brw, err := rw.w.Hijack()
+    if err != nil {
+        return nil, nil, err
+    }
+    rw.hijacked = true
+    return conn, brw, nil
+}
+
+// finish sends the response of a handler that wrote nothing, and the
+// trailers of one that declared them
+func (rw *responseWriter) finish() {
+    rw.WriteHeader(http.StatusOK)
+    declared := rw.header.Values("Trailer")
+    if len(declared) == 0 {
+        return
+    }
+    // NOTE: the headers may still be held back, the trailers need them out
+    if err := rw.w.Flush(); err != nil {
+        return
+    }
+    trailers := headers.NewHeaders()
+    for _, list := range declared {
+        for _, k := range strings.Split(list, ",") {
+            for _, v := range rw.header.Values(strings.TrimSpace(k)) {
+                trailers.Add(strings.TrimSpace(k), v)
+            }
+        }
+    }
+    rw.w.WriteTrailers(trailers)
+}
+
+// ToHTTP runs a server.Handler as a net/http handler. The handler writes
+// to a response.Writer over a pipe, the response read back from it is
+// copied to the http.ResponseWriter, flushed as it streams in.
+func ToHTTP(h server.Handler) http.Handler {
+    return http.HandlerFunc(func(rw http.ResponseWriter, hreq *http.Request) {
+        pr, pw := io.Pipe()
+        defer pr.Close()
+
+        w := response.NewWriter(pw)
+        w.SetKeepAlive(true)
+        w.SetDiscardBody(hreq.Method == http.MethodHead)
+        req := newRequest(hreq)
+
+        panicked := make(chan any, 1)
+        go func() {
+            defer func() {
+                recovered := recover()
+                if recovered != nil {
+                    pw.CloseWithError(fmt.Errorf("handler panicked: %v", recovered))
+                }
+                panicked <- recovered
+            }()
+            h(w, req)
+            pw.CloseWithError(w.Close())
+        }()
+
+        resp, err := http.ReadResponse(bufio.NewReader(pr), hreq)
+        if err == nil {
+            copyResponse(rw, resp)
+        }
+        pr.Close()
+        // NOTE: let net/http deal with the panic the way it does for its
+        // own handlers
+        if recovered := <-panicked; recovered != nil {
+            panic(recovered)
+        }
+        if err != nil {
+            http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+        }
+    })
+}
+
+// newRequest builds the request a server.Handler sees for hreq
+func newRequest(hreq *http.Request) *request.Request {
+    req := &request.Request{
+        RequestLine: request.RequestLine{
+            HttpVersion:   fmt.Sprintf("%d.%d", hreq.ProtoMajor, hreq.ProtoMinor),
+            RequestTarget: hreq.RequestURI,
+            Method:        hreq.Method,
+        },
+        Headers:    headers.NewHeaders(),
+        Body:       request.NoBody,
+        Trailers:   headers.NewHeaders(),
+        TLS:        hreq.TLS,
+        RemoteAddr: hreq.RemoteAddr,
+    }
+    if req.RequestLine.RequestTarget == "" {
+        req.RequestLine.RequestTarget = hreq.URL.RequestURI()
+    }
+    req.Headers.Set("Host", hreq.Host)
+    for k, values := range hreq.Header {
+        for _, v := range values {
+            req.Headers.Add(k, v)
+        }
+    }
+    if hreq.Body != nil && hreq.Body != http.NoBody {
+        req.Body = hreq.Body
+        if hreq.ContentLength >= 0 {
+            req.Headers.Set("Content-Length", strconv.FormatInt(hreq.ContentLength, 10))
+        } else {
+            req.Headers.Set("Transfer-Encoding", "chunked")
+        }
+    }
+    return req.WithContext(hreq.Context())
+}
+
+// copyResponse sends resp through rw, leaving the framing to net/http
+func copyResponse(rw http.ResponseWriter, resp *http.Response) {
+    defer resp.Body.Close()
+    for k, values := range resp.Header {
+        if k == "Connection" {
+            continue
+        }
+        for _, v := range values {
+            rw.Header().Add(k, v)
+        }
+    }
+    if resp.ContentLength >= 0 {
+        rw.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+    }
+    rw.WriteHeader(resp.StatusCode)
+
+    rc := http.NewResponseController(rw)
+    buf := make([]byte, 32<<10)
+    for {
+        n, err := resp.Body.Read(buf)
+        if n > 0 {
+            if _, err := rw.Write(buf[:n]); err != nil {
+                return
+            }
+            rc.Flush()
+        }
+        if err != nil {
+            break
+        }
+    }
+    for k, values := range resp.Trailer {
+        for _, v := range values {
+            rw.Header().Add(http.TrailerPrefix+k, v)
+        }
+    }
+}
@@ -0,0 +1,223 @@
+package adapter
+
+import (
+    "io"
+    "maps"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "slices"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/mrtuuro/http-from-tcp/internal/headers"
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+    "github.com/mrtuuro/http-from-tcp/internal/response"
+    "github.com/mrtuuro/http-from-tcp/internal/servertest"
+)
+
+func TestFromHTTP(t *testing.T) {
+    h := FromHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/echo":
+            body, err := io.ReadAll(r.Body)
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return
+            }
+            w.Header().Set("X-Method", r.Method)
+            w.Header().Set("X-Host", r.Host)
+            w.Header().Set("X-Query", r.URL.Query().Get("q"))
+            w.Header().Set("X-Remote", r.RemoteAddr)
+            w.Header().Set("X-Request-Id", "inner")
+            w.WriteHeader(http.StatusCreated)
+            w.Write(body)
+        case "/stream":
+            w.Header().Set("Trailer", "X-Sum")
+            w.Write([]byte("one "))
+            w.(http.Flusher).Flush()
+            w.Write([]byte("two"))
+            w.Header().Set("X-Sum", "2")
+        case "/upload":
+            declared := strings.Join(slices.Sorted(maps.Keys(r.Trailer)), ",")
+            body, err := io.ReadAll(r.Body)
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return
+            }
+            w.Header().Set("X-Declared", declared)
+            w.Header().Set("X-Checksum", r.Trailer.Get("X-Checksum"))
+            w.Header().Set("X-Trailer", r.Header.Get("Trailer"))
+            w.Write(body)
+        case "/empty":
+        }
+    }))
+    addr := servertest.Listen(t, func(w *response.Writer, req *request.Request) {
+        w.Header().Set("X-Request-Id", "outer")
+        h(w, req)
+    })
+    client := &http.Client{Timeout: 2 * time.Second}
+
+    // TEST: Request and response go through both ways
+    resp, err := client.Post("http://"+addr+"/echo?q=hi", "text/plain", strings.NewReader("hello"))
+    require.NoError(t, err)
+    body, err := io.ReadAll(resp.Body)
+    require.NoError(t, err)
+    resp.Body.Close()
+    assert.Equal(t, http.StatusCreated, resp.StatusCode)
+    assert.Equal(t, "hello", string(body))
+    assert.Equal(t, "POST", resp.Header.Get("X-Method"))
+    assert.Equal(t, addr, resp.Header.Get("X-Host"))
+    assert.Equal(t, "hi", resp.Header.Get("X-Query"))
+    assert.NotEmpty(t, resp.Header.Get("X-Remote"))
+    assert.Equal(t, int64(5), resp.ContentLength)
+
+    // TEST: Fields the handler sets replace ones set before it ran
+    assert.Equal(t, []string{"inner"}, resp.Header.Values("X-Request-Id"))
+
+    // TEST: Trailers of chunked uploads show up once the body is read
+    pr, pw := io.Pipe()
+    go func() {
+        pw.Write([]byte("chunked "))
+        pw.Write([]byte("upload"))
+        pw.Close()
+    }()
+    req, err := http.NewRequest("POST", "http://"+addr+"/upload", pr)
+    require.NoError(t, err)
+    req.Trailer = http.Header{"X-Checksum": []string{"abc"}}
+    resp, err = client.Do(req)
+    require.NoError(t, err)
+    body, err = io.ReadAll(resp.Body)
+    require.NoError(t, err)
+    resp.Body.Close()
+    assert.Equal(t, http.StatusOK, resp.StatusCode)
+    assert.Equal(t, "chunked upload", string(body))
+    assert.Equal(t, "X-Checksum", resp.Header.Get("X-Declared"))
+    assert.Equal(t, "abc", resp.Header.Get("X-Checksum"))
+    assert.Empty(t, resp.Header.Get("X-Trailer"))
+
+    // TEST: Flushed bodies are chunked and carry the declared trailers
+    resp, err = client.Get("http://" + addr + "/stream")
+    require.NoError(t, err)
+    body, err = io.ReadAll(resp.Body)
+    require.NoError(t, err)
+    resp.Body.Close()
+    assert.Equal(t, "one two", string(body))
+    assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+    assert.Equal(t, "2", resp.Trailer.Get("X-Sum"))
+
+    // TEST: A handler that writes nothing sends an empty 200
+    resp, err = client.Get("http://" + addr + "/empty")
+    require.NoError(t, err)
+    resp.Body.Close()
+    assert.Equal(t, http.StatusOK, resp.StatusCode)
+    assert.Equal(t, int64(0), resp.ContentLength)
+    assert.Equal(t, []string{"outer"}, resp.Header.Values("X-Request-Id"))
+}
+
+func TestFromHTTPHijack(t *testing.T) {
+    addr := servertest.Listen(t, FromHTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        conn, brw, err := w.(http.Hijacker).Hijack()
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        defer conn.Close()
+        _, err = w.Write([]byte("late"))
+        assert.ErrorIs(t, err, http.ErrHijacked)
+
+        brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+        brw.Flush()
+        line, err := brw.ReadString('\n')
+        if err != nil {
+            return
+        }
+        brw.WriteString("echo: " + line)
+        brw.Flush()
+    })))
+
+    // TEST: The handler owns the connection, bytes sent after the request
+    // included
+    conn, err := net.Dial("tcp", addr)
+    require.NoError(t, err)
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(2 * time.Second))
+    _, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nping\n"))
+    require.NoError(t, err)
+    out, err := io.ReadAll(conn)
+    require.NoError(t, err)
+    assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\necho: ping\n", string(out))
+}
+
+func TestToHTTP(t *testing.T) {
+    h := ToHTTP(func(w *response.Writer, req *request.Request) {
+        switch req.RequestLine.RequestTarget {
+        case "/echo":
+            body, err := io.ReadAll(req.Body)
+            if err != nil {
+                response.WriteStatus(w, response.StatusInternalServerError, nil)
+                return
+            }
+            host, _ := req.Headers.Get("Host")
+            w.Header().Set("X-Host", host)
+            w.Header().Set("X-Version", req.RequestLine.HttpVersion)
+            w.WriteHeader(response.StatusCreated)
+            w.Write(body)
+        case "/chunked":
+            w.WriteStatusLine(response.StatusOK)
+            h := headers.NewHeaders()
+            h.Set("Transfer-Encoding", "chunked")
+            h.Set("Trailer", "X-Done")
+            w.WriteHeaders(h)
+            w.WriteChunkedBody([]byte("hello "))
+            w.WriteChunkedBody([]byte("world"))
+            trailers := headers.NewHeaders()
+            trailers.Set("X-Done", "yes")
+            w.WriteTrailers(trailers)
+        case "/panic":
+            panic("boom")
+        }
+    })
+
+    // TEST: Request and response go through both ways
+    rec := httptest.NewRecorder()
+    h.ServeHTTP(rec, httptest.NewRequest("POST", "/echo", strings.NewReader("hello")))
+    assert.Equal(t, http.StatusCreated, rec.Code)
+    assert.Equal(t, "hello", rec.Body.String())
+    assert.Equal(t, "example.com", rec.Header().Get("X-Host"))
+    assert.Equal(t, "1.1", rec.Header().Get("X-Version"))
+    assert.Equal(t, "5", rec.Header().Get("Content-Length"))
+    assert.Empty(t, rec.Header().Get("Connection"))
+
+    // TEST: Chunked bodies are passed on with their trailers
+    srv := httptest.NewServer(h)
+    defer srv.Close()
+    resp, err := http.Get(srv.URL + "/chunked")
+    require.NoError(t, err)
+    body, err := io.ReadAll(resp.Body)
+    require.NoError(t, err)
+    resp.Body.Close()
+    assert.Equal(t, "hello world", string(body))
+    assert.Equal(t, "yes", resp.Trailer.Get("X-Done"))
+
+    // TEST: HEAD keeps the headers and drops the body
+    rec = httptest.NewRecorder()
+    h.ServeHTTP(rec, httptest.NewRequest("HEAD", "/echo", nil))
+    assert.Equal(t, http.StatusCreated, rec.Code)
+    assert.Empty(t, rec.Body.String())
+
+    // TEST: A handler that writes nothing sends an empty 200
+    rec = httptest.NewRecorder()
+    h.ServeHTTP(rec, httptest.NewRequest("GET", "/empty", nil))
+    assert.Equal(t, http.StatusOK, rec.Code)
+    assert.Equal(t, "0", rec.Header().Get("Content-Length"))
+
+    // TEST: Panics reach net/http
+    assert.PanicsWithValue(t, "boom", func() {
+        h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/panic", nil))
+    })
+}
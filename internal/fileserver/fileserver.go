@@ -0,0 +1,194 @@
+package fileserver
+
+import (
+    "errors"
+    "fmt"
+    "html"
+    "io"
+    "io/fs"
+    "net/url"
+    "os"
+    "path"
+    "strings"
+
+    "github.com/mrtuuro/http-from-tcp/internal/headers"
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+    "github.com/mrtuuro/http-from-tcp/internal/response"
+    "github.com/mrtuuro/http-from-tcp/internal/server"
+)
+
+const indexPage = "index.html"
+
+type Options struct {
+    // Prefix is stripped from the request path before the file is looked
+    // up, e.g. "/static" to serve /static/app.js from <root>/app.js
+    Prefix string
+    // ListDirectories renders an HTML listing for directories without an
+    // index.html. Without it such directories are 403 Forbidden.
+    ListDirectories bool
+}
+
+// Dir serves the files under the directory root. Lookups go through
+// os.Root, so neither ".." segments nor symlinks can reach outside of it.
+func Dir(root string, opts Options) (server.Handler, error) {
+    r, err := os.OpenRoot(root)
+    if err != nil {
+        return nil, err
+    }
+    return FS(r.FS(), opts), nil
+}
+
+// FS serves the files of fsys. Files must implement io.Seeker, which the
+// files of os.DirFS, os.Root, embed.FS and fstest.MapFS all do.
+func FS(fsys fs.FS, opts Options) server.Handler {
+    fsrv := &fileServer{fsys: fsys, opts: opts}
+    return fsrv.serve
+}
+
+type fileServer struct {
+    fsys fs.FS
+    opts Options
+}
+
+func (fsrv *fileServer) serve(w *response.Writer, req *request.Request) {
+    if req.RequestLine.Method != "GET" && req.RequestLine.Method != "HEAD" {
+        h := headers.NewHeaders()
+        h.Set("Allow", "GET, HEAD")
+        response.WriteStatus(w, response.StatusMethodNotAllowed, h)
+        return
+    }
+
+    urlPath, query, _ := strings.Cut(req.RequestLine.RequestTarget, "?")
+    urlPath, err := url.PathUnescape(urlPath)
+    rel, found := strings.CutPrefix(urlPath, fsrv.opts.Prefix)
+    if err != nil || !found || rel != "" && !strings.HasPrefix(rel, "/") {
+        response.WriteStatus(w, response.StatusNotFound, nil)
+        return
+    }
+    name, ok := cleanName(rel)
+    if !ok {
+        response.WriteStatus(w, response.StatusNotFound, nil)
+        return
+    }
+
+    f, info, err := fsrv.open(name)
+    if err != nil {
+        response.WriteStatus(w, errorStatus(err), nil)
+        return
+    }
+    defer f.Close()
+
+    if info.IsDir() {
+        // NOTE: relative links in the page and the listing only work
+        // when the URL ends with a slash
+        if !strings.HasSuffix(urlPath, "/") {
+            redirect(w, path.Base(urlPath)+"/", query)
+            return
+        }
+        fsrv.serveDir(w, req, name)
+        return
+    }
+    serveFile(w, req, f, info)
+}
+
+// serveDir serves the directory's index.html, or lists it
+func (fsrv *fileServer) serveDir(w *response.Writer, req *request.Request, name string) {
+    index, info, err := fsrv.open(path.Join(name, indexPage))
+    if err == nil {
+        defer index.Close()
+        if !info.IsDir() {
+            serveFile(w, req, index, info)
+            return
+        }
+    }
+    if !fsrv.opts.ListDirectories {
+        response.WriteStatus(w, response.StatusForbidden, nil)
+        return
+    }
+    entries, err := fs.ReadDir(fsrv.fsys, name)
+    if err != nil {
+        response.WriteStatus(w, errorStatus(err), nil)
+        return
+    }
+
+    var b strings.Builder
+    b.WriteString("<!doctype html>\n<meta name=\"viewport\" content=\"width=device-width\">\n<pre>\n")
+    for _, entry := range entries {
+        entryName := entry.Name()
+        if entry.IsDir() {
+            entryName += "/"
+        }
+        link := url.URL{Path: entryName}
+        fmt.Fprintf(&b, "<a href=\"%s\">%s</a>\n", html.EscapeString(link.String()), html.EscapeString(entryName))
+    }
+    b.WriteString("</pre>\n")
+
+    body := []byte(b.String())
+    w.WriteStatusLine(response.StatusOK)
+    h := response.GetDefaultHeaders(len(body))
+    h.Set("Content-Type", "text/html; charset=utf-8")
+    w.WriteHeaders(h)
+    if req.RequestLine.Method != "HEAD" {
+        w.WriteBody(body)
+    }
+}
+
+func (fsrv *fileServer) open(name string) (fs.File, fs.FileInfo, error) {
+    f, err := fsrv.fsys.Open(name)
+    if err != nil {
+        return nil, nil, err
+    }
+    info, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return nil, nil, err
+    }
+    return f, info, nil
+}
+
+func serveFile(w *response.Writer, req *request.Request, f fs.File, info fs.FileInfo) {
+    content, ok := f.(io.ReadSeeker)
+    if !ok || !info.Mode().IsRegular() {
+        response.WriteStatus(w, response.StatusForbidden, nil)
+        return
+    }
+    // NOTE: embed.FS and fstest.MapFS files have no modification time,
+    // which would make a poor validator
+    if !info.ModTime().IsZero() {
+        w.Header().Set("ETag", response.FileETag(info.ModTime(), info.Size()))
+    }
+    response.ServeContent(w, req, info.Name(), info.ModTime(), content)
+}
+
+// cleanName turns a request path into a name for fs.FS. Paths with NUL
+// bytes or backslashes are refused outright, ".." can't climb above the
+// root since the path is cleaned as an absolute one.
+func cleanName(p string) (string, bool) {
+    if strings.ContainsAny(p, "\x00\\") {
+        return "", false
+    }
+    name := strings.TrimPrefix(path.Clean("/"+p), "/")
+    if name == "" {
+        name = "."
+    }
+    return name, fs.ValidPath(name)
+}
+
+// errorStatus maps a lookup error to a response status. Anything else
+// than a permission problem, including os.Root refusing a path that
+// escapes the root, is reported as not found.
+func errorStatus(err error) response.StatusCode {
+    if errors.Is(err, fs.ErrPermission) {
+        return response.StatusForbidden
+    }
+    return response.StatusNotFound
+}
+
+// redirect sends a redirect relative to the request path. An absolute
+// one built from the path could start with "//" and leave the site.
+func redirect(w *response.Writer, location, query string) {
+    link := url.URL{Path: location, RawQuery: query}
+    h := headers.NewHeaders()
+    h.Set("Location", link.String())
+    response.WriteStatus(w, response.StatusMovedPermanently, h)
+}
@@ -0,0 +1,145 @@
+package fileserver
+
+import (
+    "bytes"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "testing/fstest"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+    "github.com/mrtuuro/http-from-tcp/internal/response"
+    "github.com/mrtuuro/http-from-tcp/internal/servertest"
+)
+
+func TestDir(t *testing.T) {
+    outside := t.TempDir()
+    require.NoError(t, os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0o644))
+
+    root := t.TempDir()
+    require.NoError(t, os.WriteFile(filepath.Join(root, "hello.txt"), []byte("hello world"), 0o644))
+    require.NoError(t, os.WriteFile(filepath.Join(root, "page"), []byte("<!DOCTYPE html><p>hi</p>"), 0o644))
+    require.NoError(t, os.Mkdir(filepath.Join(root, "docs"), 0o755))
+    require.NoError(t, os.WriteFile(filepath.Join(root, "docs", "index.html"), []byte("<h1>docs</h1>"), 0o644))
+    require.NoError(t, os.Mkdir(filepath.Join(root, "files"), 0o755))
+    require.NoError(t, os.WriteFile(filepath.Join(root, "files", "a&b.txt"), []byte("a"), 0o644))
+    require.NoError(t, os.Mkdir(filepath.Join(root, "files", "sub"), 0o755))
+    require.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "escape.txt")))
+    require.NoError(t, os.Symlink(outside, filepath.Join(root, "escape")))
+
+    h, err := Dir(root, Options{Prefix: "/static"})
+    require.NoError(t, err)
+
+    // TEST: Content type by extension
+    out := servertest.Serve(t, h, "GET", "/static/hello.txt")
+    info, err := os.Stat(filepath.Join(root, "hello.txt"))
+    require.NoError(t, err)
+    assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+        "Accept-Ranges: bytes\r\n"+
+        "Content-Type: text/plain; charset=utf-8\r\n"+
+        "Content-Length: 11\r\n"+
+        "ETag: "+response.FileETag(info.ModTime(), 11)+"\r\n"+
+        "Last-Modified: "+info.ModTime().UTC().Format(http.TimeFormat)+"\r\n"+
+        "\r\n"+
+        "hello world", out)
+
+    // TEST: Byte ranges
+    req, err := request.RequestFromReader(strings.NewReader("GET /static/hello.txt HTTP/1.1\r\nRange: bytes=6-\r\n\r\n"))
+    require.NoError(t, err)
+    buf := &bytes.Buffer{}
+    h(response.NewWriter(buf), req)
+    assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 206 Partial Content\r\n"), buf.String())
+    assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nworld"), buf.String())
+
+    // TEST: Content type sniffed without an extension
+    out = servertest.Serve(t, h, "GET", "/static/page")
+    assert.Contains(t, out, "\r\nContent-Type: text/html; charset=utf-8\r\n")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\n<!DOCTYPE html><p>hi</p>"), out)
+
+    // TEST: HEAD sends the headers only
+    out = servertest.Serve(t, h, "HEAD", "/static/hello.txt")
+    assert.Contains(t, out, "\r\nContent-Length: 11\r\n")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\n"), out)
+
+    // TEST: Directory index
+    out = servertest.Serve(t, h, "GET", "/static/docs/")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\n<h1>docs</h1>"), out)
+
+    // TEST: Directories are redirected to their slash form
+    out = servertest.Serve(t, h, "GET", "/static/docs?v=1")
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 301 Moved Permanently\r\n"), out)
+    assert.Contains(t, out, "\r\nLocation: docs/?v=1\r\n")
+
+    // TEST: Redirects stay on the site
+    require.NoError(t, os.Mkdir(filepath.Join(root, "evil.com"), 0o755))
+    require.NoError(t, os.Mkdir(filepath.Join(root, "a:b"), 0o755))
+    bare, err := Dir(root, Options{})
+    require.NoError(t, err)
+    out = servertest.Serve(t, bare, "GET", "//evil.com")
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 301 Moved Permanently\r\n"), out)
+    assert.Contains(t, out, "\r\nLocation: evil.com/\r\n")
+    out = servertest.Serve(t, bare, "GET", "/a:b")
+    assert.Contains(t, out, "\r\nLocation: ./a:b/\r\n")
+
+    // TEST: Listing is off by default
+    out = servertest.Serve(t, h, "GET", "/static/files/")
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 403 Forbidden\r\n"), out)
+
+    // TEST: Traversal and symlinks can't leave the root
+    for _, target := range []string{
+        "/static/../secret.txt",
+        "/static/%2e%2e/%2e%2e/secret.txt",
+        "/static/..%5csecret.txt",
+        "/static/escape.txt",
+        "/static/escape/secret.txt",
+        "/static/missing.txt",
+        "/staticky/hello.txt",
+    } {
+        out = servertest.Serve(t, h, "GET", target)
+        assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"), "%s: %s", target, out)
+        assert.NotContains(t, out, "secret\r\n", target)
+    }
+
+    // TEST: Only GET and HEAD
+    out = servertest.Serve(t, h, "POST", "/static/hello.txt")
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"), out)
+    assert.Contains(t, out, "\r\nAllow: GET, HEAD\r\n")
+
+    // TEST: Directory listing
+    h, err = Dir(root, Options{Prefix: "/static", ListDirectories: true})
+    require.NoError(t, err)
+    out = servertest.Serve(t, h, "GET", "/static/files/")
+    assert.Contains(t, out, "\r\nContent-Type: text/html; charset=utf-8\r\n")
+    assert.Contains(t, out, `<a href="a&amp;b.txt">a&amp;b.txt</a>`)
+    assert.Contains(t, out, `<a href="sub/">sub/</a>`)
+
+    // TEST: Missing root
+    _, err = Dir(filepath.Join(root, "nope"), Options{})
+    assert.Error(t, err)
+}
+
+func TestFS(t *testing.T) {
+    fsys := fstest.MapFS{
+        "index.html":   {Data: []byte("<p>home</p>")},
+        "app.js":       {Data: []byte("console.log(1)")},
+        "img/logo.png": {Data: []byte("\x89PNG\r\n\x1a\n")},
+    }
+    h := FS(fsys, Options{})
+
+    // TEST: Root index
+    out := servertest.Serve(t, h, "GET", "/")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\n<p>home</p>"), out)
+
+    // TEST: Nested file
+    out = servertest.Serve(t, h, "GET", "/img/logo.png")
+    assert.Contains(t, out, "\r\nContent-Type: image/png\r\n")
+
+    // TEST: Percent-encoded path
+    out = servertest.Serve(t, h, "GET", "/app%2Ejs")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\nconsole.log(1)"), out)
+}
@@ -3,18 +3,30 @@ package headers
 import (
     "bytes"
     "fmt"
+    "io"
     "strings"
 )
 
 const crlf = "\r\n"
 
-type Headers map[string]string
+// Field is a single field line, with the name in its original casing
+type Field struct {
+    Name  string
+    Value string
+}
+
+// Headers is an ordered list of field lines. Every line is kept separately
+// and in insertion order, names are matched case-insensitively but written
+// back the way they were added.
+type Headers struct {
+    fields []Field
+}
 
-func NewHeaders() Headers {
-    return map[string]string{}
+func NewHeaders() *Headers {
+    return &Headers{}
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
     // print the data with crlf encoding
 
     idx := bytes.Index(data, []byte(crlf))
@@ -27,53 +39,160 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
         return 2, true, nil
     }
 
-    parts := bytes.SplitN(data[:idx], []byte(":"), 2)
-    key := strings.ToLower(string(parts[0]))
+    line := data[:idx]
+    // NOTE: a line starting with whitespace continues the previous field
+    // (obs-fold). Taking it as a field of its own lets this parser and one
+    // that unfolds it disagree on the framing, so it is rejected instead
+    // (RFC 9112 5.2).
+    if line[0] == ' ' || line[0] == '\t' {
+        return 0, false, fmt.Errorf("invalid header line, obsolete line folding: %q", line)
+    }
+    colon := bytes.IndexByte(line, ':')
+    if colon == -1 {
+        return 0, false, fmt.Errorf("invalid header line, missing colon: %q", line)
+    }
+    key := string(line[:colon])
 
-    if key != strings.TrimRight(key, " ") {
+    if key != strings.TrimRight(key, " \t") {
         return 0, false, fmt.Errorf("invalid header name: %s", key)
     }
 
-    value := bytes.TrimSpace(parts[1])
-    key = strings.TrimSpace(key)
-    if !validTokens([]byte(key)) {
-        return 0, false, fmt.Errorf("invalid header token found: %s", key)
+    value := string(bytes.Trim(line[colon+1:], " \t"))
+    if !ValidFieldName(key) {
+        return 0, false, fmt.Errorf("invalid header token found: %q", key)
+    }
+    if !ValidFieldValue(value) {
+        return 0, false, fmt.Errorf("invalid header value for %s: %q", key, value)
     }
-    h.Set(key, string(value))
+    h.Add(key, value)
     return idx + 2, false, nil
 }
 
-func (h Headers) Get(key []byte) ([]byte, bool) {
-    keyStr := string(bytes.ToLower(key))
-    v, ok := h[keyStr]
-    return []byte(v), ok
+// Get returns the combined value of all field lines named key, joined
+// with ", " as RFC 9110 5.3 allows for list-based fields. Use Values for
+// fields that must not be combined, like Set-Cookie.
+func (h *Headers) Get(key string) (string, bool) {
+    values := h.Values(key)
+    if len(values) == 0 {
+        return "", false
+    }
+    return strings.Join(values, ", "), true
+}
 
+// Values returns the values of all field lines named key, in order
+func (h *Headers) Values(key string) []string {
+    var values []string
+    for _, f := range h.fields {
+        if strings.EqualFold(f.Name, key) {
+            values = append(values, f.Value)
+        }
+    }
+    return values
 }
 
-func (h Headers) Set(key, value string) {
-    key = strings.ToLower(key)
-    v, ok := h[key]
-    if ok {
-        value = strings.Join([]string{
-            v,
-            value,
-        }, ", ")
+// Add appends a new field line, keeping any existing lines with the same name
+func (h *Headers) Add(key, value string) {
+    h.fields = append(h.fields, Field{Name: key, Value: value})
+}
+
+// Set replaces all field lines named key with a single one. It takes the
+// place of the first existing line, or goes last if there was none.
+func (h *Headers) Set(key, value string) {
+    for i, f := range h.fields {
+        if strings.EqualFold(f.Name, key) {
+            h.fields[i] = Field{Name: key, Value: value}
+            h.del(key, i+1)
+            return
+        }
+    }
+    h.Add(key, value)
+}
+
+// Del removes all field lines named key
+func (h *Headers) Del(key string) {
+    h.del(key, 0)
+}
+
+// del removes the field lines named key at index from or later
+func (h *Headers) del(key string, from int) {
+    kept := h.fields[:from]
+    for _, f := range h.fields[from:] {
+        if !strings.EqualFold(f.Name, key) {
+            kept = append(kept, f)
+        }
     }
-    h[key] = value
+    h.fields = kept
 }
 
-func (h Headers) Override(key, value string) {
-    key = strings.ToLower(key)
-    h[key] = value
+// Range calls fn for every field line in order until fn returns false
+func (h *Headers) Range(fn func(key, value string) bool) {
+    for _, f := range h.fields {
+        if !fn(f.Name, f.Value) {
+            return
+        }
+    }
 }
 
-func (h Headers) Del(key string) {
-    key= strings.ToLower(key)
-    delete(h, key)
+// Len returns the number of field lines
+func (h *Headers) Len() int {
+    return len(h.fields)
+}
+
+// Clone returns a copy that can be modified independently
+func (h *Headers) Clone() *Headers {
+    return &Headers{fields: append([]Field(nil), h.fields...)}
+}
+
+// WriteTo writes every field line as "Name: value\r\n", in order. The
+// blank line ending the section is left to the caller.
+func (h *Headers) WriteTo(w io.Writer) (int64, error) {
+    var total int64
+    for _, f := range h.fields {
+        n, err := fmt.Fprintf(w, "%s: %s\r\n", f.Name, f.Value)
+        total += int64(n)
+        if err != nil {
+            return total, err
+        }
+    }
+    return total, nil
+}
+
+// Validate checks that every field line can go on the wire as is, which
+// keeps handler supplied values from smuggling in extra lines
+func (h *Headers) Validate() error {
+    for _, f := range h.fields {
+        if !ValidFieldName(f.Name) {
+            return fmt.Errorf("invalid header token found: %q", f.Name)
+        }
+        if !ValidFieldValue(f.Value) {
+            return fmt.Errorf("invalid header value for %s: %q", f.Name, f.Value)
+        }
+    }
+    return nil
 }
 
 var tokenChars = []byte{'!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~'}
 
+// ValidFieldName reports whether name is a non-empty token (RFC 9110 5.1)
+func ValidFieldName(name string) bool {
+    return name != "" && validTokens([]byte(name))
+}
+
+// ValidFieldValue reports whether value only holds field-vchar, SP, HTAB
+// and obs-text (RFC 9110 5.5). CR, LF, NUL and other controls are rejected.
+func ValidFieldValue(value string) bool {
+    for i := 0; i < len(value); i++ {
+        c := value[i]
+        if c == '\t' || c == ' ' {
+            continue
+        }
+        if c < 0x21 || c == 0x7f {
+            return false
+        }
+    }
+    return true
+}
+
 // validTokens checks if the data contains only valid tokens
 // or characters that are allowed in a token
 func validTokens(data []byte) bool {
@@ -81,7 +200,7 @@ func validTokens(data []byte) bool {
         if !(c >= 'A' && c <= 'Z' ||
         c >= 'a' && c <= 'z' ||
         c >= '0' && c <= '9' ||
-        c == '-') {
+        bytes.IndexByte(tokenChars, c) != -1) {
             return false
         }
     }
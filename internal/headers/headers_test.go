@@ -1,6 +1,7 @@
 package headers
 
 import (
+    "bytes"
     "testing"
 
     "github.com/stretchr/testify/assert"
@@ -14,28 +15,39 @@ func TestHeadersParse(t *testing.T) {
     n, done, err := headers.Parse(data)
     require.NoError(t, err)
     require.NotNil(t, headers)
-    assert.Equal(t, "localhost:42069", headers["host"])
+    assert.Equal(t, "localhost:42069", value(headers, "host"))
     assert.Equal(t, 23, n)
     assert.False(t, done)
 
     // Test: Valid single header with extra whitespace
     headers = NewHeaders()
-    data = []byte("       Host: localhost:42069                           \r\n\r\n")
+    data = []byte("Host:        localhost:42069                           \r\n\r\n")
     n, done, err = headers.Parse(data)
     require.NoError(t, err)
     require.NotNil(t, headers)
-    assert.Equal(t, "localhost:42069", headers["host"])
+    assert.Equal(t, "localhost:42069", value(headers, "host"))
     assert.Equal(t, 57, n)
     assert.False(t, done)
 
+    // Test: Leading whitespace is obs-fold, not a new field
+    for _, line := range []string{"       Host: localhost:42069\r\n\r\n", "\tContent-Length: 3\r\n\r\n"} {
+        headers = NewHeaders()
+        n, done, err = headers.Parse([]byte(line))
+        require.Error(t, err)
+        assert.Equal(t, 0, n)
+        assert.False(t, done)
+        assert.Equal(t, 0, headers.Len())
+    }
+
     // Test: Valid 2 headers with existing headers
-    headers = map[string]string{"host": "localhost:42069"}
+    headers = NewHeaders()
+    headers.Add("Host", "localhost:42069")
     data = []byte("User-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n")
     n, done, err = headers.Parse(data)
     require.NoError(t, err)
     require.NotNil(t, headers)
-    assert.Equal(t, "localhost:42069", headers["host"])
-    assert.Equal(t, "curl/7.81.0", headers["user-agent"])
+    assert.Equal(t, "localhost:42069", value(headers, "host"))
+    assert.Equal(t, "curl/7.81.0", value(headers, "user-agent"))
     assert.Equal(t, 25, n)
     assert.False(t, done)
 
@@ -45,7 +57,7 @@ func TestHeadersParse(t *testing.T) {
     n, done, err = headers.Parse(data)
     require.NoError(t, err)
     require.NotNil(t, headers)
-    assert.Empty(t, headers)
+    assert.Equal(t, 0, headers.Len())
     assert.Equal(t, 2, n)
     assert.True(t, done)
 
@@ -66,3 +78,121 @@ func TestHeadersParse(t *testing.T) {
     assert.False(t, done)
 }
 
+func TestHeadersOrderAndCase(t *testing.T) {
+    // TEST: Parsed names keep their casing and order
+    headers := NewHeaders()
+    data := []byte("Host: localhost:42069\r\nSet-Cookie: a=1\r\nX-Trace-ID: abc\r\nset-cookie: b=2\r\n\r\n")
+    total := 0
+    for {
+        n, done, err := headers.Parse(data[total:])
+        require.NoError(t, err)
+        total += n
+        if done {
+            break
+        }
+    }
+    assert.Equal(t, 4, headers.Len())
+    assert.Equal(t, []string{"a=1", "b=2"}, headers.Values("SET-COOKIE"))
+    buf := &bytes.Buffer{}
+    _, err := headers.WriteTo(buf)
+    require.NoError(t, err)
+    assert.Equal(t, "Host: localhost:42069\r\nSet-Cookie: a=1\r\nX-Trace-ID: abc\r\nset-cookie: b=2\r\n", buf.String())
+
+    // TEST: Set replaces every line in place of the first one
+    headers.Set("Set-Cookie", "c=3")
+    assert.Equal(t, []string{"c=3"}, headers.Values("set-cookie"))
+    var names []string
+    headers.Range(func(key, value string) bool {
+        names = append(names, key)
+        return true
+    })
+    assert.Equal(t, []string{"Host", "Set-Cookie", "X-Trace-ID"}, names)
+
+    // TEST: Add keeps repeated fields as separate lines
+    headers.Add("Vary", "Accept")
+    headers.Add("Vary", "Accept-Encoding")
+    assert.Equal(t, "Accept, Accept-Encoding", value(headers, "vary"))
+    assert.Equal(t, 5, headers.Len())
+
+    // TEST: Del removes every line
+    headers.Del("VARY")
+    _, found := headers.Get("Vary")
+    assert.False(t, found)
+    assert.Equal(t, 3, headers.Len())
+
+    // TEST: Clone is independent
+    clone := headers.Clone()
+    clone.Set("Host", "other")
+    assert.Equal(t, "localhost:42069", value(headers, "host"))
+    assert.Equal(t, "other", value(clone, "host"))
+}
+
+func value(h *Headers, key string) string {
+    v, _ := h.Get(key)
+    return v
+}
+
+func TestHeadersValidation(t *testing.T) {
+    // TEST: Every tchar is allowed in names
+    headers := NewHeaders()
+    data := []byte("X_Custom!#$%&'*+-.^_`|~09: value\r\n\r\n")
+    n, done, err := headers.Parse(data)
+    require.NoError(t, err)
+    assert.Equal(t, 34, n)
+    assert.False(t, done)
+    assert.Equal(t, "value", value(headers, "x_custom!#$%&'*+-.^_`|~09"))
+
+    // TEST: Sec-CH-UA+ style names
+    headers = NewHeaders()
+    data = []byte("Sec-CH-UA+: \"Chromium\";v=\"124\"\r\n\r\n")
+    _, _, err = headers.Parse(data)
+    require.NoError(t, err)
+    assert.Equal(t, "\"Chromium\";v=\"124\"", value(headers, "sec-ch-ua+"))
+
+    // TEST: Tabs and obs-text in values
+    headers = NewHeaders()
+    data = []byte("X-Note: caf\xe9\tlatte \r\n\r\n")
+    _, _, err = headers.Parse(data)
+    require.NoError(t, err)
+    assert.Equal(t, "caf\xe9\tlatte", value(headers, "x-note"))
+
+    // TEST: Empty value
+    headers = NewHeaders()
+    data = []byte("X-Empty:\r\n\r\n")
+    _, _, err = headers.Parse(data)
+    require.NoError(t, err)
+    assert.Equal(t, "", value(headers, "x-empty"))
+
+    // TEST: Missing colon
+    headers = NewHeaders()
+    data = []byte("Host\r\n\r\n")
+    n, _, err = headers.Parse(data)
+    require.Error(t, err)
+    assert.Equal(t, 0, n)
+
+    // TEST: Empty name
+    headers = NewHeaders()
+    data = []byte(": value\r\n\r\n")
+    _, _, err = headers.Parse(data)
+    require.Error(t, err)
+
+    // TEST: Separators are not tchar
+    headers = NewHeaders()
+    data = []byte("X(Bad): value\r\n\r\n")
+    _, _, err = headers.Parse(data)
+    require.Error(t, err)
+
+    // TEST: Bare CR, bare LF and NUL in values
+    for _, line := range []string{"X-A: a\rb\r\n\r\n", "X-A: a\nb\r\n\r\n", "X-A: a\x00b\r\n\r\n", "X-A: a\x7fb\r\n\r\n"} {
+        headers = NewHeaders()
+        _, _, err = headers.Parse([]byte(line))
+        require.Error(t, err, "%q", line)
+    }
+
+    // TEST: Validate catches values added by hand
+    headers = NewHeaders()
+    headers.Add("X-Ok", "fine")
+    require.NoError(t, headers.Validate())
+    headers.Add("X-Injected", "a\r\nSet-Cookie: evil=1")
+    require.Error(t, headers.Validate())
+}
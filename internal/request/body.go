@@ -0,0 +1,192 @@
+package request
+
+import (
+    "errors"
+    "io"
+)
+
+// ErrBodyReadAfterClose is returned when reading a Request.Body after Close
+var ErrBodyReadAfterClose = errors.New("request: read on closed body")
+
+// ErrBodyNotConsumed is returned by Reader.ReadRequest while the previous
+// request body still has unread bytes on the wire
+var ErrBodyNotConsumed = errors.New("request: previous request body not consumed")
+
+// ErrBodyTooLargeToDrain is returned by Request.Body.Close when too much of
+// the body is left unread to skip it and reuse the connection
+var ErrBodyTooLargeToDrain = errors.New("request: unread body too large to drain")
+
+// maxDrainBytes caps how much of an unread body Close discards to keep
+// the connection usable for the next request
+const maxDrainBytes = 256 << 10
+
+// NoBody is the Request.Body of requests that carry no message body
+var NoBody = noBody{}
+
+type noBody struct{}
+
+func (noBody) Read([]byte) (int, error) { return 0, io.EOF }
+func (noBody) Close() error             { return nil }
+
+// bufferedReader holds the bytes read off the wire that the parser has not
+// consumed yet. The header parser and the body share it so nothing that
+// was read past the end of the headers gets lost.
+type bufferedReader struct {
+    src         io.Reader
+    buf         []byte
+    readToIndex int
+}
+
+// fill reads more data into the buffer, growing it when it is full
+func (br *bufferedReader) fill() error {
+    if br.readToIndex >= len(br.buf) {
+        newBuf := make([]byte, len(br.buf)*2)
+        copy(newBuf, br.buf)
+        br.buf = newBuf
+    }
+    n, err := br.src.Read(br.buf[br.readToIndex:])
+    br.readToIndex += n
+    if n > 0 {
+        return nil
+    }
+    return err
+}
+
+func (br *bufferedReader) buffered() []byte {
+    return br.buf[:br.readToIndex]
+}
+
+func (br *bufferedReader) consume(n int) {
+    copy(br.buf, br.buf[n:br.readToIndex])
+    br.readToIndex -= n
+}
+
+// read hands out buffered bytes first and only then reads straight from
+// the source, so large bodies never go through the parse buffer
+func (br *bufferedReader) read(p []byte) (int, error) {
+    if br.readToIndex > 0 {
+        n := copy(p, br.buffered())
+        br.consume(n)
+        return n, nil
+    }
+    return br.src.Read(p)
+}
+
+// body streams a request body off the connection, decoding the
+// Content-Length or chunked framing on the way
+type body struct {
+    req      *Request
+    r        *bufferedReader
+    err      error
+    closed   bool
+    closeErr error
+}
+
+func (b *body) Read(p []byte) (int, error) {
+    if b.closed {
+        return 0, ErrBodyReadAfterClose
+    }
+    if b.err != nil {
+        return 0, b.err
+    }
+    if len(p) == 0 {
+        return 0, nil
+    }
+    n, err := b.read(p)
+    if err != nil {
+        b.err = err
+    }
+    return n, err
+}
+
+func (b *body) read(p []byte) (int, error) {
+    req := b.req
+    for {
+        switch req.state {
+        case requestStateDone:
+            return 0, io.EOF
+        case requestStateParsingBody:
+            return b.readData(p, req.bodyLength-req.bodyLengthRead)
+        case requestStateParsingChunkData:
+            return b.readData(p, req.chunkRemaining)
+        }
+
+        // NOTE: chunk framing and trailers go through the state machine
+        prevState := req.state
+        n, err := req.parse(b.r.buffered())
+        if err != nil {
+            return 0, err
+        }
+        b.r.consume(n)
+        if n > 0 || req.state != prevState {
+            continue
+        }
+        if err := b.r.fill(); err != nil {
+            if errors.Is(err, io.EOF) {
+                return 0, &ParseError{Kind: KindIncompleteRequest, Detail: "body", Err: io.ErrUnexpectedEOF}
+            }
+            return 0, err
+        }
+    }
+}
+
+// readData copies at most remaining bytes of payload into p
+func (b *body) readData(p []byte, remaining int64) (int, error) {
+    req := b.req
+    if int64(len(p)) > remaining {
+        p = p[:remaining]
+    }
+    n, err := b.r.read(p)
+
+    switch req.state {
+    case requestStateParsingBody:
+        req.bodyLengthRead += int64(n)
+        if req.bodyLengthRead == req.bodyLength {
+            req.state = requestStateDone
+        }
+    case requestStateParsingChunkData:
+        req.chunkRemaining -= int64(n)
+        if req.chunkRemaining == 0 {
+            req.state = requestStateParsingChunkEnd
+        }
+    }
+
+    if errors.Is(err, io.EOF) {
+        if n > 0 {
+            return n, nil
+        }
+        return 0, &ParseError{Kind: KindIncompleteRequest, Detail: "body", Err: io.ErrUnexpectedEOF}
+    }
+    return n, err
+}
+
+// Close discards whatever is left of the body so the next request on the
+// connection can be parsed. It fails when the remainder is too large or
+// the body turned out to be malformed.
+func (b *body) Close() error {
+    if b.closed {
+        return b.closeErr
+    }
+    b.closed = true
+    b.closeErr = b.drain()
+    return b.closeErr
+}
+
+func (b *body) drain() error {
+    if b.err != nil && !errors.Is(b.err, io.EOF) {
+        return b.err
+    }
+    buf := make([]byte, 512)
+    var drained int64
+    for b.req.state != requestStateDone {
+        if drained > maxDrainBytes {
+            return ErrBodyTooLargeToDrain
+        }
+        n, err := b.read(buf)
+        drained += int64(n)
+        if err != nil && !errors.Is(err, io.EOF) {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,103 @@
+package request
+
+import (
+    "compress/gzip"
+    "compress/zlib"
+    "io"
+    "strings"
+)
+
+// DecodeBody replaces Body with one that undoes the gzip and deflate
+// Content-Encoding of the request. Content-Encoding and Content-Length are
+// dropped from Headers since they describe the encoded body.
+//
+// maxBytes caps the decoded length, reading past it fails with
+// ErrBodyTooLarge; 0 means no limit, which a small compressed body can
+// turn into an unbounded amount of data. Any other coding fails with
+// ErrUnsupportedContentEncoding and leaves the request untouched.
+func (r *Request) DecodeBody(maxBytes int64) error {
+    contentEncoding, found := r.Headers.Get("Content-Encoding")
+    if !found {
+        return nil
+    }
+    var codings []string
+    for _, coding := range strings.Split(contentEncoding, ",") {
+        coding = strings.ToLower(strings.TrimSpace(coding))
+        switch coding {
+        case "", "identity":
+        case "gzip", "x-gzip", "deflate":
+            codings = append(codings, coding)
+        default:
+            return newParseError(KindUnsupportedContentEncoding, "%s", contentEncoding)
+        }
+    }
+
+    r.Headers.Del("Content-Encoding")
+    r.Headers.Del("Content-Length")
+    if r.Body == NoBody {
+        return nil
+    }
+    var body io.ReadCloser = r.Body
+    // NOTE: codings are listed in the order they were applied
+    for i := len(codings) - 1; i >= 0; i-- {
+        body = &decodedBody{src: body, coding: codings[i]}
+    }
+    r.Body = &limitedBody{ReadCloser: body, remaining: maxBytes, limit: maxBytes}
+    return nil
+}
+
+// decodedBody decompresses src. The decompressor is only set up on the
+// first Read, as it starts by reading the stream header off the wire.
+type decodedBody struct {
+    src     io.ReadCloser
+    coding  string
+    decoder io.ReadCloser
+}
+
+func (d *decodedBody) Read(p []byte) (int, error) {
+    if d.decoder == nil {
+        var err error
+        if d.coding == "deflate" {
+            d.decoder, err = zlib.NewReader(d.src)
+        } else {
+            d.decoder, err = gzip.NewReader(d.src)
+        }
+        if err != nil {
+            return 0, err
+        }
+    }
+    return d.decoder.Read(p)
+}
+
+func (d *decodedBody) Close() error {
+    if d.decoder != nil {
+        d.decoder.Close()
+    }
+    return d.src.Close()
+}
+
+// limitedBody fails once more than limit bytes are read, 0 means no limit
+type limitedBody struct {
+    io.ReadCloser
+    remaining int64
+    limit     int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+    if l.limit <= 0 {
+        return l.ReadCloser.Read(p)
+    }
+    // NOTE: read one byte past the limit to tell a body of exactly limit
+    // bytes from a larger one
+    if int64(len(p)) > l.remaining+1 {
+        p = p[:l.remaining+1]
+    }
+    n, err := l.ReadCloser.Read(p)
+    if int64(n) > l.remaining {
+        n = int(l.remaining)
+        l.remaining = 0
+        return n, newParseError(KindBodyTooLarge, "decoded body over %d bytes", l.limit)
+    }
+    l.remaining -= int64(n)
+    return n, err
+}
@@ -0,0 +1,131 @@
+package request
+
+import (
+    "fmt"
+)
+
+// ErrorKind classifies why a request could not be parsed
+type ErrorKind int
+
+const (
+    KindMalformedRequestLine ErrorKind = iota + 1
+    KindUnsupportedVersion
+    KindInvalidMethod
+    KindInvalidHeader
+    KindBadContentLength
+    KindConflictingFraming
+    KindUnsupportedTransferCoding
+    KindMalformedChunk
+    KindRequestLineTooLong
+    KindHeaderFieldsTooLarge
+    KindBodyTooLarge
+    KindIncompleteRequest
+    KindUnsupportedContentEncoding
+)
+
+var kindText = map[ErrorKind]string{
+    KindMalformedRequestLine:       "malformed request-line",
+    KindUnsupportedVersion:         "unsupported HTTP version",
+    KindInvalidMethod:              "invalid method",
+    KindInvalidHeader:              "invalid header field",
+    KindBadContentLength:           "bad Content-Length",
+    KindConflictingFraming:         "conflicting message framing",
+    KindUnsupportedTransferCoding:  "unsupported transfer coding",
+    KindMalformedChunk:             "malformed chunked encoding",
+    KindRequestLineTooLong:         "request-line too long",
+    KindHeaderFieldsTooLarge:       "header fields too large",
+    KindBodyTooLarge:               "body too large",
+    KindIncompleteRequest:          "incomplete request",
+    KindUnsupportedContentEncoding: "unsupported content coding",
+}
+
+// kindStatus is the HTTP status code a server should answer each kind with
+var kindStatus = map[ErrorKind]int{
+    KindMalformedRequestLine:       400,
+    KindUnsupportedVersion:         505,
+    KindInvalidMethod:              400,
+    KindInvalidHeader:              400,
+    KindBadContentLength:           400,
+    KindConflictingFraming:         400,
+    KindUnsupportedTransferCoding:  501,
+    KindMalformedChunk:             400,
+    KindRequestLineTooLong:         414,
+    KindHeaderFieldsTooLarge:       431,
+    KindBodyTooLarge:               413,
+    KindIncompleteRequest:          400,
+    KindUnsupportedContentEncoding: 415,
+}
+
+func (k ErrorKind) String() string {
+    if text, ok := kindText[k]; ok {
+        return text
+    }
+    return fmt.Sprintf("unknown error kind %d", int(k))
+}
+
+// ParseError is returned for every request that breaks the protocol. Use
+// errors.As to get at the Kind and the status code to answer with, or
+// errors.Is against the Err* values below to test for a single kind.
+type ParseError struct {
+    Kind   ErrorKind
+    Detail string
+    // Err is the underlying cause, if any
+    Err error
+}
+
+func (e *ParseError) Error() string {
+    msg := "request: " + e.Kind.String()
+    if e.Detail != "" {
+        msg += ": " + e.Detail
+    }
+    if e.Err != nil {
+        msg += ": " + e.Err.Error()
+    }
+    return msg
+}
+
+func (e *ParseError) Unwrap() error {
+    return e.Err
+}
+
+// Is matches any ParseError of the same kind, so the Err* values work
+// with errors.Is regardless of the detail attached
+func (e *ParseError) Is(target error) bool {
+    t, ok := target.(*ParseError)
+    return ok && t.Kind == e.Kind
+}
+
+// StatusCode is the HTTP status code the request should be answered with
+func (e *ParseError) StatusCode() int {
+    if code, ok := kindStatus[e.Kind]; ok {
+        return code
+    }
+    return 400
+}
+
+func newParseError(kind ErrorKind, format string, args ...any) *ParseError {
+    return &ParseError{
+        Kind:   kind,
+        Detail: fmt.Sprintf(format, args...),
+    }
+}
+
+var (
+    ErrMalformedRequestLine      = &ParseError{Kind: KindMalformedRequestLine}
+    ErrUnsupportedVersion        = &ParseError{Kind: KindUnsupportedVersion}
+    ErrInvalidMethod             = &ParseError{Kind: KindInvalidMethod}
+    ErrInvalidHeader             = &ParseError{Kind: KindInvalidHeader}
+    ErrBadContentLength          = &ParseError{Kind: KindBadContentLength}
+    ErrConflictingFraming        = &ParseError{Kind: KindConflictingFraming}
+    ErrUnsupportedTransferCoding = &ParseError{Kind: KindUnsupportedTransferCoding}
+    ErrMalformedChunk            = &ParseError{Kind: KindMalformedChunk}
+    ErrIncompleteRequest         = &ParseError{Kind: KindIncompleteRequest}
+    // ErrRequestLineTooLong maps to 414 URI Too Long
+    ErrRequestLineTooLong = &ParseError{Kind: KindRequestLineTooLong}
+    // ErrHeaderFieldsTooLarge maps to 431 Request Header Fields Too Large
+    ErrHeaderFieldsTooLarge = &ParseError{Kind: KindHeaderFieldsTooLarge}
+    // ErrBodyTooLarge maps to 413 Content Too Large
+    ErrBodyTooLarge = &ParseError{Kind: KindBodyTooLarge}
+    // ErrUnsupportedContentEncoding maps to 415 Unsupported Media Type
+    ErrUnsupportedContentEncoding = &ParseError{Kind: KindUnsupportedContentEncoding}
+)
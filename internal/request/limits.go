@@ -0,0 +1,62 @@
+package request
+
+// Limits caps how much a single request may send. A zero field means no limit.
+type Limits struct {
+    // MaxRequestLineBytes caps the request-line, CRLF excluded
+    MaxRequestLineBytes int
+    // MaxHeaderBytes caps a single header (or trailer) field line, CRLF
+    // excluded. It also bounds chunk-size lines of chunked bodies.
+    MaxHeaderBytes int
+    // MaxTotalHeaderBytes caps all header and trailer field lines together
+    MaxTotalHeaderBytes int
+    // MaxHeaderCount caps the number of header and trailer field lines
+    MaxHeaderCount int
+    // MaxBodyBytes caps the decoded body length
+    MaxBodyBytes int64
+}
+
+// DefaultLimits are used by NewReader and RequestFromReader
+var DefaultLimits = Limits{
+    MaxRequestLineBytes: 8 << 10,
+    MaxHeaderBytes:      8 << 10,
+    MaxTotalHeaderBytes: 64 << 10,
+    MaxHeaderCount:      100,
+}
+
+// checkRequestLine fails once a request-line of size bytes can no longer
+// fit the limit
+func (r *Request) checkRequestLine(size int) error {
+    if max := r.limits.MaxRequestLineBytes; max > 0 && size > max {
+        return newParseError(KindRequestLineTooLong, "over %d bytes", max)
+    }
+    return nil
+}
+
+// checkFieldLine accounts for a header or trailer field line of size bytes.
+// complete is false while the line is still waiting for its CRLF.
+func (r *Request) checkFieldLine(size int, complete bool) error {
+    l := r.limits
+    if l.MaxHeaderBytes > 0 && size > l.MaxHeaderBytes {
+        return newParseError(KindHeaderFieldsTooLarge, "field line over %d bytes", l.MaxHeaderBytes)
+    }
+    if l.MaxTotalHeaderBytes > 0 && r.headerBytes+size > l.MaxTotalHeaderBytes {
+        return newParseError(KindHeaderFieldsTooLarge, "header section over %d bytes", l.MaxTotalHeaderBytes)
+    }
+    if !complete {
+        return nil
+    }
+    r.headerBytes += size
+    r.headerCount++
+    if l.MaxHeaderCount > 0 && r.headerCount > l.MaxHeaderCount {
+        return newParseError(KindHeaderFieldsTooLarge, "more than %d field lines", l.MaxHeaderCount)
+    }
+    return nil
+}
+
+// checkBodyLength fails when a body of length bytes exceeds the limit
+func (r *Request) checkBodyLength(length int64) error {
+    if max := r.limits.MaxBodyBytes; max > 0 && length > max {
+        return newParseError(KindBodyTooLarge, "over %d bytes", max)
+    }
+    return nil
+}
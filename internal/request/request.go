@@ -2,6 +2,8 @@ package request
 
 import (
     "bytes"
+    "context"
+    "crypto/tls"
     "errors"
     "fmt"
     "io"
@@ -13,11 +15,64 @@ import (
 
 type Request struct {
     RequestLine RequestLine
-    Headers     headers.Headers
-    Body        []byte
+    Headers     *headers.Headers
+    Body        io.ReadCloser
+    Trailers    *headers.Headers
+    // TLS holds the negotiated connection state for requests received
+    // over TLS, nil otherwise
+    TLS *tls.ConnectionState
+    // RemoteAddr is the network address of the client, set by the server
+    RemoteAddr string
 
-    state requestState
-    bodyLengthRead int
+    state          requestState
+    bodyLength     int64
+    bodyLengthRead int64
+    chunkRemaining int64
+
+    limits      Limits
+    headerBytes int
+    headerCount int
+
+    pathValues map[string]string
+    ctx        context.Context
+}
+
+// Context returns the request's context. Servers cancel it when the client
+// goes away, which is noticed once the body has been read to the end, the
+// server shuts down or the response deadline passes. It is never nil; it
+// defaults to context.Background.
+func (r *Request) Context() context.Context {
+    if r.ctx != nil {
+        return r.ctx
+    }
+    return context.Background()
+}
+
+// WithContext returns a shallow copy of r using ctx, for middleware to pass
+// values such as a request ID down to later handlers. The copy shares its
+// body with r.
+func (r *Request) WithContext(ctx context.Context) *Request {
+    if ctx == nil {
+        panic("nil context")
+    }
+    r2 := new(Request)
+    *r2 = *r
+    r2.ctx = ctx
+    return r2
+}
+
+// PathValue returns the value of the named path parameter captured by a
+// router, or "" if there is none
+func (r *Request) PathValue(name string) string {
+    return r.pathValues[name]
+}
+
+// SetPathValue sets name to value, so later calls to PathValue return it
+func (r *Request) SetPathValue(name, value string) {
+    if r.pathValues == nil {
+        r.pathValues = make(map[string]string)
+    }
+    r.pathValues[name] = value
 }
 
 type RequestLine struct {
@@ -32,49 +87,107 @@ const (
     requestStateInitialized requestState = iota
     requestStateParsingHeaders
     requestStateParsingBody
+    requestStateParsingChunkSize
+    requestStateParsingChunkData
+    requestStateParsingChunkEnd
+    requestStateParsingTrailers
     requestStateDone
 )
 
 const crlf = "\r\n"
 const bufferSize = 8
 
+// Reader parses consecutive requests off a single connection. Bytes read
+// past the end of one request stay buffered for the next, so pipelined
+// requests arriving back to back are not lost.
+type Reader struct {
+    br     *bufferedReader
+    last   *Request
+    limits Limits
+}
+
+func NewReader(reader io.Reader) *Reader {
+    return NewReaderWithLimits(reader, DefaultLimits)
+}
+
+func NewReaderWithLimits(reader io.Reader, limits Limits) *Reader {
+    return &Reader{
+        br: &bufferedReader{
+            src: reader,
+            buf: make([]byte, bufferSize, bufferSize),
+        },
+        limits: limits,
+    }
+}
+
+// RequestFromReader parses the request-line and headers off reader and
+// returns as soon as the header section is complete. The body is left on
+// the wire and streamed through Request.Body as the handler reads it.
 func RequestFromReader(reader io.Reader) (*Request, error) {
-    buf := make([]byte, bufferSize, bufferSize)
-    readToIndex := 0
+    return NewReader(reader).ReadRequest()
+}
+
+// WaitForRequest blocks until at least one byte of the next request has
+// arrived, which lets callers tell an idle connection from a slow one
+func (r *Reader) WaitForRequest() error {
+    if r.br.readToIndex > 0 {
+        return nil
+    }
+    return r.br.fill()
+}
+
+// Buffered returns a copy of the bytes read off the connection that no
+// request has consumed yet: the unread part of the current body, or the
+// start of a pipelined request
+func (r *Reader) Buffered() []byte {
+    return bytes.Clone(r.br.buffered())
+}
+
+// ReadRequest parses the next request on the connection. The body of the
+// previous request has to be read to EOF or closed first. A connection
+// closed cleanly between two requests yields io.EOF.
+func (r *Reader) ReadRequest() (*Request, error) {
+    if r.last != nil && r.last.state != requestStateDone {
+        return nil, ErrBodyNotConsumed
+    }
+
     req := &Request{
-        state:   requestStateInitialized,
-        Headers: headers.NewHeaders(),
-        Body: make([]byte, 0),
+        state:    requestStateInitialized,
+        Headers:  headers.NewHeaders(),
+        Body:     NoBody,
+        Trailers: headers.NewHeaders(),
+        limits:   r.limits,
     }
-    for req.state != requestStateDone {
+    for req.state == requestStateInitialized || req.state == requestStateParsingHeaders {
 
-        // NOTE: Read into buffer
-        numBytesRead, err := reader.Read(buf[readToIndex:])
+        // NOTE: Parse from buffer, a pipelined request may already be in there
+        numBytesParsed, err := req.parse(r.br.buffered())
         if err != nil {
-            if errors.Is(io.EOF, err) {
-                if req.state != requestStateDone {
-                    return nil, fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d", req.state, numBytesRead)
-                }
-                break
-            }
             return nil, err
         }
-        readToIndex += numBytesRead
-        if readToIndex >= len(buf) {
-            newBuf := make([]byte, len(buf)*2)
-            copy(newBuf, buf)
-            buf = newBuf
+        r.br.consume(numBytesParsed)
+        if numBytesParsed > 0 {
+            continue
         }
 
-        // NOTE: Parse from buffer
-        numBytesParsed, err := req.parse(buf[:readToIndex])
+        // NOTE: Read into buffer
+        err = r.br.fill()
         if err != nil {
+            if errors.Is(err, io.EOF) {
+                if req.state == requestStateInitialized && r.br.readToIndex == 0 {
+                    return nil, io.EOF
+                }
+                return nil, newParseError(KindIncompleteRequest, "in state: %d, unparsed bytes on EOF: %d", req.state, r.br.readToIndex)
+            }
             return nil, err
         }
+    }
 
-        copy(buf, buf[numBytesParsed:])
-        readToIndex -= numBytesParsed
+    if req.state != requestStateDone {
+        // NOTE: whatever is left in the buffer is the start of the body
+        req.Body = &body{req: req, r: r.br}
     }
+    r.last = req
     return req, nil
 }
 
@@ -94,13 +207,13 @@ func parseRequestLine(data []byte) (*RequestLine, int, error) {
 func requestLineFromString(str string) (*RequestLine, error) {
     parts := strings.Split(str, " ")
     if len(parts) != 3 {
-        return nil, fmt.Errorf("poorly formatted request-line: %s", str)
+        return nil, newParseError(KindMalformedRequestLine, "poorly formatted request-line: %s", str)
     }
 
     method := parts[0]
     for _, c := range method {
         if c < 'A' || c > 'Z' {
-            return nil, fmt.Errorf("invalid method: %s", method)
+            return nil, newParseError(KindInvalidMethod, "%s", method)
         }
     }
 
@@ -108,16 +221,16 @@ func requestLineFromString(str string) (*RequestLine, error) {
 
     versionParts := strings.Split(parts[2], "/")
     if len(versionParts) != 2 {
-        return nil, fmt.Errorf("malformed start-line: %s", str)
+        return nil, newParseError(KindMalformedRequestLine, "malformed start-line: %s", str)
     }
 
     httpPart := versionParts[0]
     if httpPart != "HTTP" {
-        return nil, fmt.Errorf("unrecognized HTTP-version: %s", httpPart)
+        return nil, newParseError(KindMalformedRequestLine, "unrecognized HTTP-name: %s", httpPart)
     }
     version := versionParts[1]
     if version != "1.1" {
-        return nil, fmt.Errorf("unrecognized HTTP-version: %s", version)
+        return nil, newParseError(KindUnsupportedVersion, "HTTP/%s", version)
     }
 
     return &RequestLine{
@@ -130,12 +243,20 @@ func requestLineFromString(str string) (*RequestLine, error) {
 func (r *Request) parse(data []byte) (int, error) {
     totalBytesParsed := 0
     for r.state != requestStateDone {
+        prevState := r.state
         n, err := r.parseSingle(data[totalBytesParsed:])
         if err != nil {
             return 0, err
         }
         totalBytesParsed += n
-        if n == 0 {
+        // NOTE: a state change without consuming bytes (e.g. headers -> chunk size)
+        // still counts as progress, so only stop when nothing happened at all
+        if n == 0 && r.state == prevState {
+            break
+        }
+        // NOTE: stop at the end of the header section, the body is pulled
+        // on demand by Request.Body
+        if prevState == requestStateParsingHeaders && r.state != prevState {
             break
         }
     }
@@ -152,7 +273,10 @@ func (r *Request) parseSingle(data []byte) (int, error) {
         }
         if n == 0 {
             // just need more data
-            return 0, nil
+            return 0, r.checkRequestLine(len(data))
+        }
+        if err := r.checkRequestLine(n - len(crlf)); err != nil {
+            return 0, err
         }
         r.RequestLine = *requestLine
         r.state = requestStateParsingHeaders
@@ -160,41 +284,185 @@ func (r *Request) parseSingle(data []byte) (int, error) {
     case requestStateParsingHeaders:
         n, done, err := r.Headers.Parse(data)
         if err != nil {
+            return 0, &ParseError{Kind: KindInvalidHeader, Err: err}
+        }
+        if err := r.checkParsedField(data, n, done); err != nil {
             return 0, err
         }
         if done {
-            r.state = requestStateParsingBody
+            if err := r.prepareBody(); err != nil {
+                return 0, err
+            }
         }
         return n, nil
-    case requestStateParsingBody:
-        contentLen, found := r.Headers.Get([]byte("Content-Length"))
-        if !found {
-            r.state = requestStateDone
-            return len(data), nil
+    case requestStateParsingBody, requestStateParsingChunkData:
+        // body bytes are copied straight into the caller's buffer by body.Read
+        return 0, nil
+    case requestStateParsingChunkSize:
+        size, n, err := parseChunkSize(data)
+        if err != nil {
+            return 0, err
         }
-
-
-        contentLenStr := string(contentLen)
-        contentLenInt, err := strconv.Atoi(contentLenStr)
+        if n == 0 {
+            if max := r.limits.MaxHeaderBytes; max > 0 && len(data) > max {
+                return 0, newParseError(KindMalformedChunk, "chunk-size line over %d bytes", max)
+            }
+            return 0, nil
+        }
+        if size == 0 {
+            // last-chunk, only the trailer section is left
+            r.state = requestStateParsingTrailers
+            return n, nil
+        }
+        // NOTE: for chunked bodies bodyLength is the sum of the chunk sizes so far
+        r.bodyLength += size
+        if err := r.checkBodyLength(r.bodyLength); err != nil {
+            return 0, err
+        }
+        r.chunkRemaining = size
+        r.state = requestStateParsingChunkData
+        return n, nil
+    case requestStateParsingChunkEnd:
+        if len(data) < len(crlf) {
+            return 0, nil
+        }
+        if !bytes.HasPrefix(data, []byte(crlf)) {
+            return 0, newParseError(KindMalformedChunk, "chunk data not terminated by CRLF")
+        }
+        r.state = requestStateParsingChunkSize
+        return len(crlf), nil
+    case requestStateParsingTrailers:
+        n, done, err := r.Trailers.Parse(data)
         if err != nil {
-            return 0, fmt.Errorf("error: malformed Content-Length: %s", err)
+            return 0, &ParseError{Kind: KindInvalidHeader, Err: err}
         }
-
-        r.Body = append(r.Body, data...)
-        r.bodyLengthRead += len(data)
-        if r.bodyLengthRead > contentLenInt {
-            return 0, fmt.Errorf("error: content-len is not equal to body length")
+        if err := r.checkParsedField(data, n, done); err != nil {
+            return 0, err
         }
-
-        if r.bodyLengthRead == contentLenInt {
+        if done {
             r.state = requestStateDone
-            return len(r.Body), nil
         }
-        return len(data), nil
-
+        return n, nil
     case requestStateDone:
         return 0, fmt.Errorf("error: trying to read data in a done state")
     default:
         return 0, fmt.Errorf("unknown state")
     }
 }
+
+// checkParsedField applies the header limits after a Headers.Parse call
+// that consumed n bytes of data
+func (r *Request) checkParsedField(data []byte, n int, done bool) error {
+    if done {
+        return nil
+    }
+    if n == 0 {
+        return r.checkFieldLine(len(data), false)
+    }
+    return r.checkFieldLine(n-len(crlf), true)
+}
+
+// prepareBody picks the message framing once the headers are in.
+// Transfer-Encoding takes precedence over Content-Length (RFC 9112 6.3).
+func (r *Request) prepareBody() error {
+    if te, found := r.Headers.Get("Transfer-Encoding"); found {
+        // NOTE: a request carrying both is a classic smuggling vector,
+        // RFC 9112 6.3 allows rejecting it outright
+        if _, found := r.Headers.Get("Content-Length"); found {
+            return newParseError(KindConflictingFraming, "both Transfer-Encoding and Content-Length present")
+        }
+        // NOTE: chunked is the only coding decoded, anything layered on top
+        // of it, or chunked applied twice, would reach the handler still
+        // encoded
+        if !strings.EqualFold(strings.TrimSpace(te), "chunked") {
+            return newParseError(KindUnsupportedTransferCoding, "%s", te)
+        }
+        r.state = requestStateParsingChunkSize
+        return nil
+    }
+
+    contentLen, found := r.Headers.Get("Content-Length")
+    if !found {
+        r.state = requestStateDone
+        return nil
+    }
+
+    // NOTE: repeated Content-Length lines are joined with ", " by Headers,
+    // identical values are fine, differing ones are not
+    values := strings.Split(contentLen, ",")
+    for _, v := range values[1:] {
+        if strings.TrimSpace(v) != strings.TrimSpace(values[0]) {
+            return newParseError(KindConflictingFraming, "Content-Length: %s", contentLen)
+        }
+    }
+    contentLenStr := strings.TrimSpace(values[0])
+    for _, c := range contentLenStr {
+        if c < '0' || c > '9' {
+            return newParseError(KindBadContentLength, "%s", contentLen)
+        }
+    }
+    contentLenInt, err := strconv.ParseInt(contentLenStr, 10, 64)
+    if err != nil || contentLenInt < 0 {
+        return newParseError(KindBadContentLength, "%s", contentLen)
+    }
+    if err := r.checkBodyLength(contentLenInt); err != nil {
+        return err
+    }
+    r.bodyLength = contentLenInt
+    if r.bodyLength == 0 {
+        r.state = requestStateDone
+        return nil
+    }
+    r.state = requestStateParsingBody
+    return nil
+}
+
+// parseChunkSize parses a chunk-size line: chunk-size [ chunk-ext ] CRLF.
+// Chunk extensions are validated loosely and otherwise ignored.
+func parseChunkSize(data []byte) (int64, int, error) {
+    idx := bytes.Index(data, []byte(crlf))
+    if idx == -1 {
+        return 0, 0, nil
+    }
+    line := data[:idx]
+    sizePart := line
+    if semi := bytes.IndexByte(line, ';'); semi != -1 {
+        sizePart = line[:semi]
+        if err := validChunkExtensions(line[semi:]); err != nil {
+            return 0, 0, err
+        }
+    }
+    sizePart = bytes.TrimRight(sizePart, " \t")
+    if len(sizePart) == 0 || len(sizePart) > 15 {
+        return 0, 0, newParseError(KindMalformedChunk, "chunk size: %q", line)
+    }
+
+    var size int64
+    for _, c := range sizePart {
+        var digit byte
+        switch {
+        case c >= '0' && c <= '9':
+            digit = c - '0'
+        case c >= 'a' && c <= 'f':
+            digit = c - 'a' + 10
+        case c >= 'A' && c <= 'F':
+            digit = c - 'A' + 10
+        default:
+            return 0, 0, newParseError(KindMalformedChunk, "chunk size: %q", line)
+        }
+        size = size<<4 | int64(digit)
+    }
+    return size, idx + 2, nil
+}
+
+// validChunkExtensions checks a run of ';name[=value]' chunk extensions
+func validChunkExtensions(ext []byte) error {
+    for _, part := range bytes.Split(ext[1:], []byte(";")) {
+        name, _, _ := bytes.Cut(part, []byte("="))
+        name = bytes.Trim(name, " \t")
+        if len(name) == 0 {
+            return newParseError(KindMalformedChunk, "chunk extension: %q", ext)
+        }
+    }
+    return nil
+}
@@ -1,9 +1,16 @@
 package request
 
 import (
+    "bytes"
+    "compress/gzip"
+    "compress/zlib"
+    "context"
     "io"
+    "strconv"
+    "strings"
     "testing"
 
+    "github.com/mrtuuro/http-from-tcp/internal/headers"
     "github.com/stretchr/testify/assert"
     "github.com/stretchr/testify/require"
 )
@@ -79,9 +86,9 @@ func TestHeadersParse(t *testing.T) {
     r, err := RequestFromReader(reader)
     require.NoError(t, err)
     require.NotNil(t, r)
-    assert.Equal(t, "localhost:42069", r.Headers["host"])
-    assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-    assert.Equal(t, "*/*", r.Headers["accept"])
+    assert.Equal(t, "localhost:42069", value(r.Headers, "host"))
+    assert.Equal(t, "curl/7.81.0", value(r.Headers, "user-agent"))
+    assert.Equal(t, "*/*", value(r.Headers, "accept"))
 
     // TEST: Empty Headers
     reader = &chunkReader{
@@ -91,7 +98,7 @@ func TestHeadersParse(t *testing.T) {
     r, err = RequestFromReader(reader)
     require.NoError(t, err)
     require.NotNil(t, r)
-    assert.Empty(t, r.Headers)
+    assert.Equal(t, 0, r.Headers.Len())
 
     // TEST: Malformed Header
     reader = &chunkReader{
@@ -109,7 +116,7 @@ func TestHeadersParse(t *testing.T) {
     r, err = RequestFromReader(reader)
     require.NoError(t, err)
     require.NotNil(t, r)
-    assert.Equal(t, "localhost:42069, duplicate:8080", r.Headers["host"])
+    assert.Equal(t, "localhost:42069, duplicate:8080", value(r.Headers, "host"))
 
     // TEST: Case Insensitive Headers
     reader = &chunkReader{
@@ -119,8 +126,8 @@ func TestHeadersParse(t *testing.T) {
     r, err = RequestFromReader(reader)
     require.NoError(t, err)
     require.NotNil(t, r)
-    assert.Equal(t, "localhost:42069", r.Headers["host"])
-    assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
+    assert.Equal(t, "localhost:42069", value(r.Headers, "host"))
+    assert.Equal(t, "curl/7.81.0", value(r.Headers, "user-agent"))
 
     // TEST: Missing End of Headers
     reader = &chunkReader{
@@ -145,7 +152,9 @@ func TestBodyParsing(t *testing.T) {
     r, err := RequestFromReader(reader)
     require.NoError(t, err)
     require.NotNil(t, r)
-    assert.Equal(t, "hello world!\n", string(r.Body))
+    body, err := io.ReadAll(r.Body)
+    require.NoError(t, err)
+    assert.Equal(t, "hello world!\n", string(body))
 
     // TEST: Empty Body, 0 reported content length(valid)
     reader = &chunkReader{
@@ -158,7 +167,9 @@ func TestBodyParsing(t *testing.T) {
     r, err = RequestFromReader(reader)
     require.NoError(t, err)
     require.NotNil(t, r)
-    assert.Equal(t, "", string(r.Body))
+    body, err = io.ReadAll(r.Body)
+    require.NoError(t, err)
+    assert.Equal(t, "", string(body))
 
     // TEST: Empty Body, no reported content length (valid)
     reader = &chunkReader{
@@ -183,7 +194,10 @@ func TestBodyParsing(t *testing.T) {
         numBytesPerRead: 3,
     }
     r, err = RequestFromReader(reader)
-    require.Error(t, err)
+    require.NoError(t, err)
+    require.NotNil(t, r)
+    _, err = io.ReadAll(r.Body)
+    require.ErrorIs(t, err, io.ErrUnexpectedEOF)
 
     // TEST: No Content-Length but Body Exists (valid)
     reader = &chunkReader{
@@ -196,9 +210,458 @@ func TestBodyParsing(t *testing.T) {
     r, err = RequestFromReader(reader)
     require.NoError(t, err)
     require.NotNil(t, r)
-    assert.Equal(t, "", string(r.Body))
+    body, err = io.ReadAll(r.Body)
+    require.NoError(t, err)
+    assert.Equal(t, "", string(body))
+}
+
+func TestChunkedBodyParsing(t *testing.T) {
+    // TEST: Standard chunked body
+    reader := &chunkReader{
+        data: "POST /submit HTTP/1.1\r\n" +
+        "Host: localhost:42069\r\n" +
+        "Transfer-Encoding: chunked\r\n" +
+        "\r\n" +
+        "5\r\nhello\r\n" +
+        "7\r\n world!\r\n" +
+        "0\r\n" +
+        "\r\n",
+        numBytesPerRead: 3,
+    }
+    r, err := RequestFromReader(reader)
+    require.NoError(t, err)
+    require.NotNil(t, r)
+    body, err := io.ReadAll(r.Body)
+    require.NoError(t, err)
+    assert.Equal(t, "hello world!", string(body))
+    assert.Equal(t, 0, r.Trailers.Len())
+
+    // TEST: Chunk extensions and hex sizes
+    reader = &chunkReader{
+        data: "POST /submit HTTP/1.1\r\n" +
+        "Host: localhost:42069\r\n" +
+        "Transfer-Encoding: chunked\r\n" +
+        "\r\n" +
+        "A;name=value\r\n0123456789\r\n" +
+        "1 ; ext\r\n!\r\n" +
+        "0;last\r\n" +
+        "\r\n",
+        numBytesPerRead: 1,
+    }
+    r, err = RequestFromReader(reader)
+    require.NoError(t, err)
+    require.NotNil(t, r)
+    body, err = io.ReadAll(r.Body)
+    require.NoError(t, err)
+    assert.Equal(t, "0123456789!", string(body))
+
+    // TEST: Trailer fields
+    reader = &chunkReader{
+        data: "POST /submit HTTP/1.1\r\n" +
+        "Host: localhost:42069\r\n" +
+        "Transfer-Encoding: chunked\r\n" +
+        "Trailer: X-Checksum\r\n" +
+        "\r\n" +
+        "4\r\ndata\r\n" +
+        "0\r\n" +
+        "X-Checksum: abc123\r\n" +
+        "\r\n",
+        numBytesPerRead: 4,
+    }
+    r, err = RequestFromReader(reader)
+    require.NoError(t, err)
+    require.NotNil(t, r)
+    body, err = io.ReadAll(r.Body)
+    require.NoError(t, err)
+    assert.Equal(t, "data", string(body))
+    assert.Equal(t, "abc123", value(r.Trailers, "x-checksum"))
+
+    // TEST: Transfer-Encoding together with Content-Length is rejected
+    reader = &chunkReader{
+        data: "POST /submit HTTP/1.1\r\n" +
+        "Host: localhost:42069\r\n" +
+        "Content-Length: 100\r\n" +
+        "Transfer-Encoding: chunked\r\n" +
+        "\r\n" +
+        "2\r\nhi\r\n" +
+        "0\r\n" +
+        "\r\n",
+        numBytesPerRead: 8,
+    }
+    r, err = RequestFromReader(reader)
+    require.ErrorIs(t, err, ErrConflictingFraming)
+
+    // TEST: Invalid chunk size
+    reader = &chunkReader{
+        data: "POST /submit HTTP/1.1\r\n" +
+        "Host: localhost:42069\r\n" +
+        "Transfer-Encoding: chunked\r\n" +
+        "\r\n" +
+        "zz\r\nhello\r\n" +
+        "0\r\n" +
+        "\r\n",
+        numBytesPerRead: 3,
+    }
+    r, err = RequestFromReader(reader)
+    require.NoError(t, err)
+    require.NotNil(t, r)
+    _, err = io.ReadAll(r.Body)
+    require.Error(t, err)
+
+    // TEST: Chunk data longer than chunk size
+    reader = &chunkReader{
+        data: "POST /submit HTTP/1.1\r\n" +
+        "Host: localhost:42069\r\n" +
+        "Transfer-Encoding: chunked\r\n" +
+        "\r\n" +
+        "3\r\nhello\r\n" +
+        "0\r\n" +
+        "\r\n",
+        numBytesPerRead: 3,
+    }
+    r, err = RequestFromReader(reader)
+    require.NoError(t, err)
+    require.NotNil(t, r)
+    _, err = io.ReadAll(r.Body)
+    require.Error(t, err)
+
+    // TEST: Missing terminating chunk
+    reader = &chunkReader{
+        data: "POST /submit HTTP/1.1\r\n" +
+        "Host: localhost:42069\r\n" +
+        "Transfer-Encoding: chunked\r\n" +
+        "\r\n" +
+        "5\r\nhello\r\n",
+        numBytesPerRead: 3,
+    }
+    r, err = RequestFromReader(reader)
+    require.NoError(t, err)
+    require.NotNil(t, r)
+    _, err = io.ReadAll(r.Body)
+    require.Error(t, err)
+
+    // TEST: Unsupported transfer coding
+    reader = &chunkReader{
+        data: "POST /submit HTTP/1.1\r\n" +
+        "Host: localhost:42069\r\n" +
+        "Transfer-Encoding: gzip\r\n" +
+        "\r\n" +
+        "hello",
+        numBytesPerRead: 3,
+    }
+    r, err = RequestFromReader(reader)
+    require.Error(t, err)
+
+    // TEST: Codings other than a single chunked are refused
+    for _, te := range []string{"gzip, chunked", "chunked, chunked", "chunked\r\nTransfer-Encoding: chunked", "identity, chunked"} {
+        reader = &chunkReader{
+            data: "POST /submit HTTP/1.1\r\n" +
+            "Host: localhost:42069\r\n" +
+            "Transfer-Encoding: " + te + "\r\n" +
+            "\r\n" +
+            "5\r\nhello\r\n0\r\n\r\n",
+            numBytesPerRead: 3,
+        }
+        _, err = RequestFromReader(reader)
+        assert.ErrorIs(t, err, ErrUnsupportedTransferCoding, te)
+    }
+
+    // TEST: chunked is case insensitive
+    reader = &chunkReader{
+        data: "POST /submit HTTP/1.1\r\n" +
+        "Host: localhost:42069\r\n" +
+        "Transfer-Encoding: Chunked\r\n" +
+        "\r\n" +
+        "5\r\nhello\r\n0\r\n\r\n",
+        numBytesPerRead: 3,
+    }
+    r, err = RequestFromReader(reader)
+    require.NoError(t, err)
+    body, err = io.ReadAll(r.Body)
+    require.NoError(t, err)
+    assert.Equal(t, "hello", string(body))
+}
+
+func TestReaderPipelining(t *testing.T) {
+    // TEST: Back to back requests in the same buffer
+    reader := NewReader(&chunkReader{
+        data: "POST /first HTTP/1.1\r\n" +
+        "Content-Length: 5\r\n" +
+        "\r\n" +
+        "hello" +
+        "POST /second HTTP/1.1\r\n" +
+        "Transfer-Encoding: chunked\r\n" +
+        "\r\n" +
+        "3\r\nhey\r\n0\r\n\r\n" +
+        "GET /third HTTP/1.1\r\n" +
+        "\r\n",
+        numBytesPerRead: 64,
+    })
+    r, err := reader.ReadRequest()
+    require.NoError(t, err)
+    assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+    body, err := io.ReadAll(r.Body)
+    require.NoError(t, err)
+    assert.Equal(t, "hello", string(body))
+
+    r, err = reader.ReadRequest()
+    require.NoError(t, err)
+    assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+    body, err = io.ReadAll(r.Body)
+    require.NoError(t, err)
+    assert.Equal(t, "hey", string(body))
+
+    r, err = reader.ReadRequest()
+    require.NoError(t, err)
+    assert.Equal(t, "/third", r.RequestLine.RequestTarget)
+
+    _, err = reader.ReadRequest()
+    require.ErrorIs(t, err, io.EOF)
+
+    // TEST: Unread body has to be closed before the next request
+    reader = NewReader(&chunkReader{
+        data: "POST /first HTTP/1.1\r\n" +
+        "Content-Length: 5\r\n" +
+        "\r\n" +
+        "hello" +
+        "GET /second HTTP/1.1\r\n" +
+        "\r\n",
+        numBytesPerRead: 3,
+    })
+    r, err = reader.ReadRequest()
+    require.NoError(t, err)
+    _, err = reader.ReadRequest()
+    require.ErrorIs(t, err, ErrBodyNotConsumed)
+    require.NoError(t, r.Body.Close())
+    r, err = reader.ReadRequest()
+    require.NoError(t, err)
+    assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+}
+
+func TestLimits(t *testing.T) {
+    limits := Limits{
+        MaxRequestLineBytes: 20,
+        MaxHeaderBytes:      30,
+        MaxTotalHeaderBytes: 50,
+        MaxHeaderCount:      3,
+        MaxBodyBytes:        10,
+    }
+
+    // TEST: Within limits
+    reader := NewReaderWithLimits(&chunkReader{
+        data:            "POST / HTTP/1.1\r\nHost: localhost:42069\r\nContent-Length: 10\r\n\r\n0123456789",
+        numBytesPerRead: 3,
+    }, limits)
+    r, err := reader.ReadRequest()
+    require.NoError(t, err)
+    body, err := io.ReadAll(r.Body)
+    require.NoError(t, err)
+    assert.Equal(t, "0123456789", string(body))
+
+    // TEST: Request-line too long, CRLF never arrives
+    reader = NewReaderWithLimits(&chunkReader{
+        data:            "GET /aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+        numBytesPerRead: 3,
+    }, limits)
+    _, err = reader.ReadRequest()
+    require.ErrorIs(t, err, ErrRequestLineTooLong)
+
+    // TEST: Request-line too long
+    reader = NewReaderWithLimits(&chunkReader{
+        data:            "GET /aaaaaaaaaaaa HTTP/1.1\r\n\r\n",
+        numBytesPerRead: 50,
+    }, limits)
+    _, err = reader.ReadRequest()
+    require.ErrorIs(t, err, ErrRequestLineTooLong)
+
+    // TEST: Single header too large
+    reader = NewReaderWithLimits(&chunkReader{
+        data:            "GET / HTTP/1.1\r\nX-Long: aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa\r\n\r\n",
+        numBytesPerRead: 3,
+    }, limits)
+    _, err = reader.ReadRequest()
+    require.ErrorIs(t, err, ErrHeaderFieldsTooLarge)
+
+    // TEST: Header section too large
+    reader = NewReaderWithLimits(&chunkReader{
+        data:            "GET / HTTP/1.1\r\nX-One: aaaaaaaaaaaaaaaa\r\nX-Two: aaaaaaaaaaaaaaaa\r\nX-Three: aaaaaaaaaa\r\n\r\n",
+        numBytesPerRead: 3,
+    }, limits)
+    _, err = reader.ReadRequest()
+    require.ErrorIs(t, err, ErrHeaderFieldsTooLarge)
+
+    // TEST: Too many headers
+    reader = NewReaderWithLimits(&chunkReader{
+        data:            "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n",
+        numBytesPerRead: 3,
+    }, limits)
+    _, err = reader.ReadRequest()
+    require.ErrorIs(t, err, ErrHeaderFieldsTooLarge)
+
+    // TEST: Content-Length over the body limit
+    reader = NewReaderWithLimits(&chunkReader{
+        data:            "POST / HTTP/1.1\r\nContent-Length: 11\r\n\r\n0123456789a",
+        numBytesPerRead: 3,
+    }, limits)
+    _, err = reader.ReadRequest()
+    require.ErrorIs(t, err, ErrBodyTooLarge)
+
+    // TEST: Chunked body over the body limit
+    reader = NewReaderWithLimits(&chunkReader{
+        data:            "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n6\r\n012345\r\n6\r\n012345\r\n0\r\n\r\n",
+        numBytesPerRead: 3,
+    }, limits)
+    r, err = reader.ReadRequest()
+    require.NoError(t, err)
+    _, err = io.ReadAll(r.Body)
+    require.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func TestParseErrors(t *testing.T) {
+    tests := []struct {
+        name       string
+        data       string
+        kind       *ParseError
+        statusCode int
+    }{
+        {"malformed request-line", "GET /\r\n\r\n", ErrMalformedRequestLine, 400},
+        {"unsupported version", "GET / HTTP/2.0\r\n\r\n", ErrUnsupportedVersion, 505},
+        {"invalid method", "get / HTTP/1.1\r\n\r\n", ErrInvalidMethod, 400},
+        {"invalid header", "GET / HTTP/1.1\r\nH©st: x\r\n\r\n", ErrInvalidHeader, 400},
+        {"obs-fold", "POST / HTTP/1.1\r\nHost: x\r\n\tContent-Length: 3\r\n\r\nabc", ErrInvalidHeader, 400},
+        {"bad content-length", "POST / HTTP/1.1\r\nContent-Length: +5\r\n\r\n", ErrBadContentLength, 400},
+        {"differing content-lengths", "POST / HTTP/1.1\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\n", ErrConflictingFraming, 400},
+        {"unsupported transfer coding", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", ErrUnsupportedTransferCoding, 501},
+        {"incomplete request", "GET / HTTP/1.1\r\nHost: x", ErrIncompleteRequest, 400},
+    }
+    for _, tc := range tests {
+        t.Run(tc.name, func(t *testing.T) {
+            _, err := RequestFromReader(&chunkReader{data: tc.data, numBytesPerRead: 3})
+            require.ErrorIs(t, err, tc.kind)
+            var perr *ParseError
+            require.ErrorAs(t, err, &perr)
+            assert.Equal(t, tc.kind.Kind, perr.Kind)
+            assert.Equal(t, tc.statusCode, perr.StatusCode())
+        })
+    }
+
+    // TEST: Identical repeated Content-Length values are accepted
+    r, err := RequestFromReader(&chunkReader{
+        data:            "POST / HTTP/1.1\r\nContent-Length: 2\r\nContent-Length: 2\r\n\r\nhi",
+        numBytesPerRead: 3,
+    })
+    require.NoError(t, err)
+    body, err := io.ReadAll(r.Body)
+    require.NoError(t, err)
+    assert.Equal(t, "hi", string(body))
+
+    // TEST: Truncated body is an incomplete request
+    r, err = RequestFromReader(&chunkReader{
+        data:            "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhi",
+        numBytesPerRead: 3,
+    })
+    require.NoError(t, err)
+    _, err = io.ReadAll(r.Body)
+    require.ErrorIs(t, err, ErrIncompleteRequest)
+    require.ErrorIs(t, err, io.ErrUnexpectedEOF)
 }
 
+func TestRequestContext(t *testing.T) {
+    r, err := RequestFromReader(&chunkReader{
+        data:            "GET /users/7 HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+        numBytesPerRead: 8,
+    })
+    require.NoError(t, err)
+
+    // TEST: Parsed requests default to the background context
+    assert.Equal(t, context.Background(), r.Context())
+
+    // TEST: WithContext returns a copy carrying the new context
+    type key struct{}
+    r.SetPathValue("id", "7")
+    r2 := r.WithContext(context.WithValue(r.Context(), key{}, "value"))
+    assert.Equal(t, "value", r2.Context().Value(key{}))
+    assert.Nil(t, r.Context().Value(key{}))
+    assert.Equal(t, "/users/7", r2.RequestLine.RequestTarget)
+    assert.Equal(t, "7", r2.PathValue("id"))
+    assert.Equal(t, r.Body, r2.Body)
+}
+
+func TestDecodeBody(t *testing.T) {
+    payload := strings.Repeat("log line\n", 1000)
+    gzipped := &bytes.Buffer{}
+    gw := gzip.NewWriter(gzipped)
+    gw.Write([]byte(payload))
+    gw.Close()
+    deflated := &bytes.Buffer{}
+    zw := zlib.NewWriter(deflated)
+    zw.Write([]byte(payload))
+    zw.Close()
+
+    newRequest := func(contentEncoding string, body []byte) *Request {
+        r, err := RequestFromReader(&chunkReader{
+            data: "POST /logs HTTP/1.1\r\nHost: localhost:42069\r\n" +
+                "Content-Encoding: " + contentEncoding + "\r\n" +
+                "Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + string(body),
+            numBytesPerRead: 512,
+        })
+        require.NoError(t, err)
+        return r
+    }
+
+    // TEST: gzip
+    r := newRequest("gzip", gzipped.Bytes())
+    require.NoError(t, r.DecodeBody(0))
+    body, err := io.ReadAll(r.Body)
+    require.NoError(t, err)
+    assert.Equal(t, payload, string(body))
+    _, found := r.Headers.Get("Content-Encoding")
+    assert.False(t, found)
+    _, found = r.Headers.Get("Content-Length")
+    assert.False(t, found)
+    require.NoError(t, r.Body.Close())
+
+    // TEST: deflate is the zlib format
+    r = newRequest("deflate", deflated.Bytes())
+    require.NoError(t, r.DecodeBody(0))
+    body, err = io.ReadAll(r.Body)
+    require.NoError(t, err)
+    assert.Equal(t, payload, string(body))
+
+    // TEST: Decoded size limit
+    r = newRequest("gzip", gzipped.Bytes())
+    require.NoError(t, r.DecodeBody(int64(len(payload))))
+    body, err = io.ReadAll(r.Body)
+    require.NoError(t, err)
+    assert.Equal(t, payload, string(body))
+
+    r = newRequest("gzip", gzipped.Bytes())
+    require.NoError(t, r.DecodeBody(100))
+    body, err = io.ReadAll(r.Body)
+    assert.ErrorIs(t, err, ErrBodyTooLarge)
+    assert.Len(t, body, 100)
+
+    // TEST: Unknown codings are refused
+    r = newRequest("br", []byte("data"))
+    err = r.DecodeBody(0)
+    assert.ErrorIs(t, err, ErrUnsupportedContentEncoding)
+    var perr *ParseError
+    require.ErrorAs(t, err, &perr)
+    assert.Equal(t, 415, perr.StatusCode())
+    assert.Equal(t, "br", value(r.Headers, "Content-Encoding"))
+
+    // TEST: identity is no coding at all
+    r = newRequest("identity", []byte("data"))
+    require.NoError(t, r.DecodeBody(0))
+    body, err = io.ReadAll(r.Body)
+    require.NoError(t, err)
+    assert.Equal(t, "data", string(body))
+}
+
+func value(h *headers.Headers, key string) string {
+    v, _ := h.Get(key)
+    return v
+}
 
 type chunkReader struct {
     data            string
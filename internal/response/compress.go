@@ -0,0 +1,250 @@
+package response
+
+import (
+    "compress/gzip"
+    "compress/zlib"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+
+    "github.com/mrtuuro/http-from-tcp/internal/headers"
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+)
+
+// defaultCompressMinLength is the smallest Content-Length worth
+// compressing, below it the gzip framing eats most of the gain
+const defaultCompressMinLength = 1024
+
+// defaultCompressTypes are the media types compressed unless
+// Compression.ContentTypes says otherwise. Images, audio, video and
+// archives are compressed already.
+var defaultCompressTypes = []string{
+    "text/*",
+    "application/json",
+    "application/javascript",
+    "application/xml",
+    "application/wasm",
+    "image/svg+xml",
+}
+
+type Compression struct {
+    // Level is the gzip or deflate compression level, 0 means the default
+    // level of compress/flate
+    Level int
+    // MinLength skips responses with a Content-Length below it, 0 means
+    // 1KB. Chunked responses are always compressed.
+    MinLength int64
+    // ContentTypes lists the media types to compress, "text/*" matches a
+    // whole type. nil means text, JSON, JavaScript, XML, SVG and WASM.
+    ContentTypes []string
+}
+
+// EnableCompression compresses the body with gzip or deflate, whichever
+// req's Accept-Encoding prefers, when the response has a compressible
+// Content-Type, no Content-Encoding of its own and isn't a 206. It must be
+// called before WriteHeaders.
+//
+// A compressed body is always sent chunked, the Content-Length the
+// handler announces is dropped and only used to tell when the body is
+// complete. A strong ETag is made weak, since the bytes on the wire differ
+// from the ones it was computed for.
+func (w *Writer) EnableCompression(req *request.Request, c Compression) {
+    acceptEncoding, _ := req.Headers.Get("Accept-Encoding")
+    w.compression = &c
+    w.coding = negotiateEncoding(acceptEncoding)
+}
+
+// startCompression rewrites the header section of a response to be
+// compressed and sets up the encoder. It runs after inspectFraming so the
+// handler's own framing is known.
+func (w *Writer) startCompression(h *headers.Headers) *headers.Headers {
+    c := w.compression
+    if c == nil || !bodyAllowed(w.statusCode) || w.statusCode == StatusPartialContent {
+        return h
+    }
+    if _, found := h.Get("Content-Encoding"); found {
+        return h
+    }
+    contentType, _ := h.Get("Content-Type")
+    if !c.compressible(contentType) {
+        return h
+    }
+    // NOTE: a body delimited by closing the connection has no end to
+    // finish the compressed stream at
+    if !w.chunked && (w.contentLength < 0 || w.contentLength < c.minLength()) {
+        return h
+    }
+
+    h = h.Clone()
+    if vary, found := h.Get("Vary"); !found || !hasToken(vary, "Accept-Encoding") && !hasToken(vary, "*") {
+        h.Add("Vary", "Accept-Encoding")
+    }
+    if w.coding == "" {
+        return h
+    }
+    h.Del("Content-Length")
+    h.Set("Content-Encoding", w.coding)
+    if !w.chunked {
+        h.Set("Transfer-Encoding", "chunked")
+    }
+    if etag, found := h.Get("ETag"); found && !strings.HasPrefix(etag, "W/") {
+        h.Set("ETag", "W/"+etag)
+    }
+    if !w.discardBody {
+        w.encoded = true
+        w.encoder = c.newEncoder(w.coding, chunkWriter{w.writer})
+    }
+    return h
+}
+
+// writeEncoded compresses p into the body. Bodies announced with a
+// Content-Length are finished as soon as all of it is written.
+func (w *Writer) writeEncoded(p []byte, flush bool) (int, error) {
+    n, err := w.encoder.Write(p)
+    w.bodyWritten += int64(n)
+    if err != nil {
+        return n, err
+    }
+    if flush {
+        return n, w.encoder.Flush()
+    }
+    if !w.chunked && w.bodyWritten >= w.contentLength {
+        w.state = writerStateDone
+        if err := w.finishEncoding(); err != nil {
+            return n, err
+        }
+        _, err = w.writer.Write([]byte("\r\n"))
+    }
+    return n, err
+}
+
+// finishEncoding flushes what's left of the compressed stream and writes
+// the last chunk
+func (w *Writer) finishEncoding() error {
+    err := w.encoder.Close()
+    w.encoder = nil
+    if err != nil {
+        return err
+    }
+    _, err = w.writer.Write([]byte("0\r\n"))
+    return err
+}
+
+func (c *Compression) minLength() int64 {
+    if c.MinLength <= 0 {
+        return defaultCompressMinLength
+    }
+    return c.MinLength
+}
+
+// compressible reports whether contentType is one of c.ContentTypes
+func (c *Compression) compressible(contentType string) bool {
+    mediaType, _, _ := strings.Cut(contentType, ";")
+    mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+    if mediaType == "" {
+        return false
+    }
+    types := c.ContentTypes
+    if types == nil {
+        types = defaultCompressTypes
+    }
+    for _, t := range types {
+        if prefix, found := strings.CutSuffix(t, "/*"); found {
+            if strings.HasPrefix(mediaType, strings.ToLower(prefix)+"/") {
+                return true
+            }
+        } else if strings.EqualFold(t, mediaType) {
+            return true
+        }
+    }
+    return false
+}
+
+type encoder interface {
+    io.WriteCloser
+    Flush() error
+}
+
+// newEncoder returns the compressor for coding. "deflate" is the zlib
+// format, not raw deflate (RFC 9110 8.4.1.2).
+func (c *Compression) newEncoder(coding string, dst io.Writer) encoder {
+    level := c.Level
+    if level == 0 {
+        level = gzip.DefaultCompression
+    }
+    if coding == "deflate" {
+        zw, err := zlib.NewWriterLevel(dst, level)
+        if err != nil {
+            zw = zlib.NewWriter(dst)
+        }
+        return zw
+    }
+    gw, err := gzip.NewWriterLevel(dst, level)
+    if err != nil {
+        gw = gzip.NewWriter(dst)
+    }
+    return gw
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding value
+// (RFC 9110 12.5.3), gzip when both weigh the same, or "" when neither is
+// acceptable
+func negotiateEncoding(acceptEncoding string) string {
+    gzipQ, deflateQ, anyQ := -1.0, -1.0, -1.0
+    for _, item := range strings.Split(acceptEncoding, ",") {
+        coding, params, _ := strings.Cut(item, ";")
+        q := 1.0
+        for _, param := range strings.Split(params, ";") {
+            key, value, found := strings.Cut(param, "=")
+            if found && strings.EqualFold(strings.TrimSpace(key), "q") {
+                var err error
+                if q, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+                    q = 0
+                }
+            }
+        }
+        switch strings.ToLower(strings.TrimSpace(coding)) {
+        case "gzip", "x-gzip":
+            gzipQ = q
+        case "deflate":
+            deflateQ = q
+        case "*":
+            anyQ = q
+        }
+    }
+    if gzipQ < 0 {
+        gzipQ = anyQ
+    }
+    if deflateQ < 0 {
+        deflateQ = anyQ
+    }
+    switch {
+    case gzipQ > 0 && gzipQ >= deflateQ:
+        return "gzip"
+    case deflateQ > 0:
+        return "deflate"
+    }
+    return ""
+}
+
+// chunkWriter sends every write as one chunk
+type chunkWriter struct {
+    w io.Writer
+}
+
+func (cw chunkWriter) Write(p []byte) (int, error) {
+    // NOTE: an empty chunk would end the body
+    if len(p) == 0 {
+        return 0, nil
+    }
+    if _, err := fmt.Fprintf(cw.w, "%x\r\n", len(p)); err != nil {
+        return 0, err
+    }
+    n, err := cw.w.Write(p)
+    if err != nil {
+        return n, err
+    }
+    _, err = cw.w.Write([]byte("\r\n"))
+    return n, err
+}
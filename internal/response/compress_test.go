@@ -0,0 +1,176 @@
+package response
+
+import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "compress/zlib"
+    "fmt"
+    "io"
+    "net/http"
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/mrtuuro/http-from-tcp/internal/headers"
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+    tests := []struct {
+        acceptEncoding string
+        want           string
+    }{
+        {"", ""},
+        {"identity", ""},
+        {"gzip", "gzip"},
+        {"deflate", "deflate"},
+        {"gzip, deflate, br", "gzip"},
+        {"deflate, gzip", "gzip"},
+        {"GZIP;Q=0.5, deflate", "deflate"},
+        {"gzip;q=0, deflate;q=0.1", "deflate"},
+        {"gzip;q=0", ""},
+        {"*", "gzip"},
+        {"*;q=0.2, gzip;q=0", "deflate"},
+        {"br, *;q=0", ""},
+        {"x-gzip", "gzip"},
+        {"gzip;q=bogus, deflate", "deflate"},
+    }
+    for _, tt := range tests {
+        assert.Equal(t, tt.want, negotiateEncoding(tt.acceptEncoding), tt.acceptEncoding)
+    }
+}
+
+// compressed runs handler on a writer with compression enabled and returns
+// the parsed response and the raw bytes written
+func compressed(t *testing.T, acceptEncoding string, c Compression, handler func(w *Writer)) (*http.Response, *Writer) {
+    t.Helper()
+    req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: " + acceptEncoding + "\r\n\r\n"))
+    require.NoError(t, err)
+    buf := &bytes.Buffer{}
+    w := NewWriter(buf)
+    w.SetKeepAlive(true)
+    w.EnableCompression(req, c)
+    handler(w)
+    resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+    require.NoError(t, err)
+    return resp, w
+}
+
+func TestCompression(t *testing.T) {
+    body := []byte(strings.Repeat(`{"hello": "world"}`, 200))
+    writeJSON := func(w *Writer) {
+        w.Header().Set("ETag", `"v1"`)
+        require.NoError(t, w.WriteStatusLine(StatusOK))
+        h := GetDefaultHeaders(len(body))
+        h.Set("Content-Type", "application/json; charset=utf-8")
+        require.NoError(t, w.WriteHeaders(h))
+        // NOTE: written in two parts to check the body ends at the last byte
+        _, err := w.WriteBody(body[:100])
+        require.NoError(t, err)
+        _, err = w.WriteBody(body[100:])
+        require.NoError(t, err)
+    }
+
+    // TEST: Content-Length body switches to chunked gzip
+    resp, w := compressed(t, "gzip, deflate", Compression{}, writeJSON)
+    assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+    assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+    assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+    assert.Equal(t, `W/"v1"`, resp.Header.Get("ETag"))
+    assert.Equal(t, "", resp.Header.Get("Content-Length"))
+    zr, err := gzip.NewReader(resp.Body)
+    require.NoError(t, err)
+    got, err := io.ReadAll(zr)
+    require.NoError(t, err)
+    assert.Equal(t, body, got)
+    assert.True(t, w.KeepAlive())
+    assert.Equal(t, int64(len(body)), w.BytesWritten())
+
+    // TEST: Writes past the announced length are refused
+    _, err = w.WriteBody([]byte("x"))
+    assert.Error(t, err)
+
+    // TEST: deflate is the zlib format
+    resp, _ = compressed(t, "deflate", Compression{}, writeJSON)
+    assert.Equal(t, "deflate", resp.Header.Get("Content-Encoding"))
+    zlr, err := zlib.NewReader(resp.Body)
+    require.NoError(t, err)
+    got, err = io.ReadAll(zlr)
+    require.NoError(t, err)
+    assert.Equal(t, body, got)
+
+    // TEST: Clients without gzip or deflate still get Vary
+    resp, _ = compressed(t, "br", Compression{}, writeJSON)
+    assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+    assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+    assert.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+    got, err = io.ReadAll(resp.Body)
+    require.NoError(t, err)
+    assert.Equal(t, body, got)
+
+    // TEST: Small bodies are sent as is
+    resp, _ = compressed(t, "gzip", Compression{MinLength: int64(len(body)) + 1}, writeJSON)
+    assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+    assert.Equal(t, "", resp.Header.Get("Vary"))
+
+    // TEST: Already compressed media types are sent as is
+    resp, _ = compressed(t, "gzip", Compression{}, func(w *Writer) {
+        w.WriteStatusLine(StatusOK)
+        h := GetDefaultHeaders(len(body))
+        h.Set("Content-Type", "video/mp4")
+        w.WriteHeaders(h)
+        w.WriteBody(body)
+    })
+    assert.Equal(t, "", resp.Header.Get("Content-Encoding"))
+    assert.Equal(t, int64(len(body)), resp.ContentLength)
+
+    // TEST: Chunked bodies keep their trailers
+    resp, w = compressed(t, "gzip", Compression{ContentTypes: []string{"text/*"}}, func(w *Writer) {
+        w.WriteStatusLine(StatusOK)
+        h := headers.NewHeaders()
+        h.Set("Content-Type", "text/plain")
+        h.Set("Transfer-Encoding", "chunked")
+        h.Set("Trailer", "X-Done")
+        w.WriteHeaders(h)
+        w.WriteChunkedBody([]byte("hello "))
+        w.WriteChunkedBody([]byte("world"))
+        w.WriteChunkedBodyDone()
+        trailers := headers.NewHeaders()
+        trailers.Set("X-Done", "yes")
+        w.WriteTrailers(trailers)
+    })
+    assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+    zr, err = gzip.NewReader(resp.Body)
+    require.NoError(t, err)
+    got, err = io.ReadAll(zr)
+    require.NoError(t, err)
+    assert.Equal(t, "hello world", string(got))
+    assert.Equal(t, "yes", resp.Trailer.Get("X-Done"))
+    assert.True(t, w.KeepAlive())
+
+    // TEST: Small Writes are compressed together, Flush pushes them out
+    var raw int
+    resp, w = compressed(t, "gzip", Compression{}, func(w *Writer) {
+        w.Header().Set("Content-Type", "text/plain")
+        for i := range 5000 {
+            n, _ := fmt.Fprintf(w, "line %d of the stream\n", i)
+            raw += n
+        }
+        require.NoError(t, w.Flush())
+        fmt.Fprint(w, "end\n")
+        require.NoError(t, w.Close())
+    })
+    assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+    wire, err := io.ReadAll(resp.Body)
+    require.NoError(t, err)
+    assert.Less(t, len(wire), raw/4)
+    zr, err = gzip.NewReader(bytes.NewReader(wire))
+    require.NoError(t, err)
+    got, err = io.ReadAll(zr)
+    require.NoError(t, err)
+    assert.Equal(t, raw+4, len(got))
+    assert.True(t, strings.HasSuffix(string(got), "line 4999 of the stream\nend\n"))
+}
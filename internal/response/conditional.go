@@ -0,0 +1,150 @@
+package response
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/mrtuuro/http-from-tcp/internal/headers"
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+)
+
+// StrongETag returns opaque as a strong entity tag. opaque must not
+// contain double quotes.
+func StrongETag(opaque string) string {
+    return `"` + opaque + `"`
+}
+
+// WeakETag returns opaque as a weak entity tag, for representations that
+// are equivalent but not byte for byte identical across changes
+func WeakETag(opaque string) string {
+    return `W/"` + opaque + `"`
+}
+
+// ContentETag returns a strong entity tag derived from the content itself,
+// for handlers that build the whole body before sending it
+func ContentETag(content []byte) string {
+    sum := sha256.Sum256(content)
+    return StrongETag(hex.EncodeToString(sum[:16]))
+}
+
+// FileETag returns a strong entity tag derived from a file's modification
+// time and size, so the file doesn't have to be read to compute it
+func FileETag(modtime time.Time, size int64) string {
+    return StrongETag(fmt.Sprintf("%x-%x", modtime.UnixNano(), size))
+}
+
+// CheckPreconditions evaluates the conditional headers of req in the
+// order of RFC 9110 13.2.2, against the ETag set in w.Header and modtime,
+// either of which may be missing. The target resource is assumed to exist.
+// A non-zero modtime is announced as Last-Modified unless w.Header has one.
+//
+// When a precondition fails it responds with 304 Not Modified or 412
+// Precondition Failed and returns true, the handler is then done.
+// Otherwise nothing is written and the handler goes on as usual.
+func CheckPreconditions(w *Writer, req *request.Request, modtime time.Time) bool {
+    modtime = modtime.Truncate(time.Second)
+    if !modtime.IsZero() {
+        if _, found := w.Header().Get("Last-Modified"); !found {
+            w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+        }
+    }
+    etag, _ := w.Header().Get("ETag")
+
+    if ifMatch, found := req.Headers.Get("If-Match"); found {
+        if !etagListMatches(ifMatch, etag, false) {
+            return writePreconditionFailed(w)
+        }
+    } else if since, found := req.Headers.Get("If-Unmodified-Since"); found {
+        t, err := http.ParseTime(since)
+        if err == nil && !modtime.IsZero() && modtime.After(t) {
+            return writePreconditionFailed(w)
+        }
+    }
+
+    method := req.RequestLine.Method
+    safe := method == "GET" || method == "HEAD"
+    if ifNoneMatch, found := req.Headers.Get("If-None-Match"); found {
+        if etagListMatches(ifNoneMatch, etag, true) {
+            if safe {
+                return writeNotModified(w)
+            }
+            return writePreconditionFailed(w)
+        }
+    } else if since, found := req.Headers.Get("If-Modified-Since"); found && safe {
+        t, err := http.ParseTime(since)
+        if err == nil && !modtime.IsZero() && !modtime.After(t) {
+            return writeNotModified(w)
+        }
+    }
+    return false
+}
+
+// writeNotModified sends a 304 with the validators and caching fields of
+// w.Header. Fields describing the body are dropped, there is none.
+func writeNotModified(w *Writer) bool {
+    for _, key := range []string{"Content-Type", "Content-Length", "Content-Encoding", "Transfer-Encoding"} {
+        w.Header().Del(key)
+    }
+    if err := w.WriteStatusLine(StatusNotModified); err == nil {
+        w.WriteHeaders(headers.NewHeaders())
+    }
+    return true
+}
+
+func writePreconditionFailed(w *Writer) bool {
+    WriteStatus(w, StatusPreconditionFailed, nil)
+    return true
+}
+
+// etagListMatches reports whether an If-Match or If-None-Match value is
+// "*" or lists etag. A malformed list matches nothing.
+func etagListMatches(list, etag string, weak bool) bool {
+    list = strings.TrimSpace(list)
+    if list == "*" {
+        return true
+    }
+    if etag == "" {
+        return false
+    }
+    for list != "" {
+        tag, rest, ok := scanETag(list)
+        if !ok {
+            return false
+        }
+        if etagsMatch(tag, etag, weak) {
+            return true
+        }
+        list = strings.TrimLeft(rest, " \t,")
+    }
+    return false
+}
+
+// scanETag splits the entity tag at the start of s from the rest
+func scanETag(s string) (etag, rest string, ok bool) {
+    start := 0
+    if strings.HasPrefix(s, "W/") {
+        start = 2
+    }
+    if len(s) < start+2 || s[start] != '"' {
+        return "", "", false
+    }
+    end := strings.IndexByte(s[start+1:], '"')
+    if end < 0 {
+        return "", "", false
+    }
+    end += start + 2
+    return s[:end], s[end:], true
+}
+
+// etagsMatch compares two entity tags (RFC 9110 8.8.3.2). The weak
+// comparison ignores the W/ prefix, the strong one fails on weak tags.
+func etagsMatch(a, b string, weak bool) bool {
+    if weak {
+        return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+    }
+    return a == b && !strings.HasPrefix(a, "W/")
+}
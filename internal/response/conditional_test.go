@@ -0,0 +1,106 @@
+package response
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+)
+
+func TestCheckPreconditions(t *testing.T) {
+    modtime := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+    const etag = `"v1"`
+    tests := []struct {
+        method      string
+        headerLines string
+        want        StatusCode
+    }{
+        {"GET", "", 0},
+        {"GET", "If-None-Match: \"v1\"\r\n", StatusNotModified},
+        {"HEAD", "If-None-Match: W/\"v1\"\r\n", StatusNotModified},
+        {"GET", "If-None-Match: \"v0\", \"v1\"\r\n", StatusNotModified},
+        {"GET", "If-None-Match: \"a,b\", \"v1\"\r\n", StatusNotModified},
+        {"GET", "If-None-Match: *\r\n", StatusNotModified},
+        {"GET", "If-None-Match: \"v2\"\r\n", 0},
+        {"GET", "If-None-Match: v1\r\n", 0},
+        {"PUT", "If-None-Match: *\r\n", StatusPreconditionFailed},
+        {"PUT", "If-Match: \"v1\"\r\n", 0},
+        {"PUT", "If-Match: *\r\n", 0},
+        {"PUT", "If-Match: \"v2\"\r\n", StatusPreconditionFailed},
+        {"PUT", "If-Match: W/\"v1\"\r\n", StatusPreconditionFailed},
+        {"GET", "If-Modified-Since: Wed, 01 May 2024 12:00:00 GMT\r\n", StatusNotModified},
+        {"GET", "If-Modified-Since: Wed, 01 May 2024 11:59:59 GMT\r\n", 0},
+        {"GET", "If-Modified-Since: yesterday\r\n", 0},
+        {"POST", "If-Modified-Since: Wed, 01 May 2024 12:00:00 GMT\r\n", 0},
+        {"PUT", "If-Unmodified-Since: Wed, 01 May 2024 12:00:00 GMT\r\n", 0},
+        {"PUT", "If-Unmodified-Since: Wed, 01 May 2024 11:59:59 GMT\r\n", StatusPreconditionFailed},
+        // NOTE: If-None-Match takes precedence over If-Modified-Since, and
+        // If-Match over If-Unmodified-Since
+        {"GET", "If-None-Match: \"v2\"\r\nIf-Modified-Since: Wed, 01 May 2024 12:00:00 GMT\r\n", 0},
+        {"PUT", "If-Match: \"v1\"\r\nIf-Unmodified-Since: Wed, 01 May 2024 11:59:59 GMT\r\n", 0},
+        // NOTE: If-Match is evaluated before If-None-Match
+        {"GET", "If-Match: \"v2\"\r\nIf-None-Match: \"v1\"\r\n", StatusPreconditionFailed},
+    }
+    for _, tt := range tests {
+        req, err := request.RequestFromReader(strings.NewReader(tt.method + " / HTTP/1.1\r\nHost: localhost\r\n" + tt.headerLines + "\r\n"))
+        require.NoError(t, err)
+        buf := &bytes.Buffer{}
+        w := NewWriter(buf)
+        w.Header().Set("ETag", etag)
+        done := CheckPreconditions(w, req, modtime)
+        assert.Equal(t, tt.want != 0, done, "%s %q", tt.method, tt.headerLines)
+        assert.Equal(t, tt.want, w.StatusCode(), "%s %q", tt.method, tt.headerLines)
+    }
+
+    // TEST: Without validators nothing matches but "*"
+    req, err := request.RequestFromReader(strings.NewReader("PUT / HTTP/1.1\r\nIf-Match: \"v1\"\r\nIf-Unmodified-Since: Wed, 01 May 2024 11:59:59 GMT\r\n\r\n"))
+    require.NoError(t, err)
+    w := NewWriter(&bytes.Buffer{})
+    assert.True(t, CheckPreconditions(w, req, time.Time{}))
+    assert.Equal(t, StatusPreconditionFailed, w.StatusCode())
+    _, found := w.Header().Get("Last-Modified")
+    assert.False(t, found)
+}
+
+func TestServeContentNotModified(t *testing.T) {
+    const content = "0123456789"
+    modtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+    setETag := func(w *Writer) {
+        w.Header().Set("ETag", `"v1"`)
+        w.Header().Set("Cache-Control", "max-age=60")
+    }
+
+    // TEST: 304 keeps the validators and caching fields but no body
+    out := serveContent(t, "GET", "If-None-Match: \"v1\"\r\n", modtime, content, setETag)
+    assert.Equal(t, "HTTP/1.1 304 Not Modified\r\n"+
+        "ETag: \"v1\"\r\n"+
+        "Cache-Control: max-age=60\r\n"+
+        "Last-Modified: Wed, 01 May 2024 12:00:00 GMT\r\n"+
+        "\r\n", out)
+
+    // TEST: The connection stays usable after a 304
+    req, err := request.RequestFromReader(strings.NewReader("GET /file HTTP/1.1\r\nIf-Modified-Since: Wed, 01 May 2024 12:00:00 GMT\r\n\r\n"))
+    require.NoError(t, err)
+    w := NewWriter(&bytes.Buffer{})
+    w.SetKeepAlive(true)
+    w.Header().Set("Content-Type", "text/plain")
+    require.NoError(t, ServeContent(w, req, "file.txt", modtime, strings.NewReader(content)))
+    assert.Equal(t, StatusNotModified, w.StatusCode())
+    assert.True(t, w.KeepAlive())
+    _, found := w.Header().Get("Content-Type")
+    assert.False(t, found)
+
+    // TEST: Failed If-Match
+    out = serveContent(t, "GET", "If-Match: \"v0\"\r\n", modtime, content, setETag)
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 412 Precondition Failed\r\n"), out)
+
+    // TEST: Stale validators get the full content
+    out = serveContent(t, "GET", "If-None-Match: \"v0\"\r\n", modtime, content, setETag)
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\n"+content), out)
+}
@@ -0,0 +1,174 @@
+package response
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "mime/multipart"
+    "net/http"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/mrtuuro/http-from-tcp/internal/headers"
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+)
+
+// sniffLen is how many bytes content type detection looks at
+const sniffLen = 512
+
+// ServeContent responds with the contents of content, streaming it rather
+// than loading it whole. The Content-Type comes from w.Header if set there,
+// then from the extension of name, and is otherwise sniffed from the first
+// bytes of content. Responses to HEAD carry the headers only.
+//
+// GET requests with a Range header get the requested parts back with 206
+// Partial Content, as multipart/byteranges when there are several, or 416
+// Range Not Satisfiable. An If-Range that doesn't match the ETag set in
+// w.Header or modtime turns the response into a full 200.
+//
+// Conditional requests are answered through CheckPreconditions, so an
+// ETag set in w.Header and a non-zero modtime both act as validators.
+func ServeContent(w *Writer, req *request.Request, name string, modtime time.Time, content io.ReadSeeker) error {
+    if CheckPreconditions(w, req, modtime) {
+        return nil
+    }
+
+    size, err := content.Seek(0, io.SeekEnd)
+    if err != nil {
+        return err
+    }
+    if _, err := content.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+
+    contentType, err := detectContentType(w, name, content)
+    if err != nil {
+        return err
+    }
+
+    h := headers.NewHeaders()
+    h.Set("Accept-Ranges", "bytes")
+    ranges, err := requestedRanges(w, req, modtime, size)
+    if errors.Is(err, errNoOverlap) {
+        h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+        return WriteStatus(w, StatusRangeNotSatisfiable, h)
+    }
+
+    statusCode := StatusOK
+    length := size
+    var boundary string
+    switch {
+    case len(ranges) == 1:
+        statusCode = StatusPartialContent
+        length = ranges[0].length
+        h.Set("Content-Range", ranges[0].contentRange(size))
+        h.Set("Content-Type", contentType)
+    case len(ranges) > 1:
+        statusCode = StatusPartialContent
+        boundary = multipart.NewWriter(io.Discard).Boundary()
+        length = multipartSize(ranges, boundary, contentType, size)
+        h.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+    default:
+        h.Set("Content-Type", contentType)
+    }
+    h.Set("Content-Length", strconv.FormatInt(length, 10))
+
+    if err := w.WriteStatusLine(statusCode); err != nil {
+        return err
+    }
+    if err := w.WriteHeaders(h); err != nil {
+        return err
+    }
+    if req.RequestLine.Method == "HEAD" {
+        return nil
+    }
+
+    switch {
+    case len(ranges) == 1:
+        return copyRange(w, content, ranges[0])
+    case len(ranges) > 1:
+        mw := multipart.NewWriter(w)
+        mw.SetBoundary(boundary)
+        for _, r := range ranges {
+            part, err := mw.CreatePart(rangePartHeader(r, contentType, size))
+            if err != nil {
+                return err
+            }
+            if err := copyRange(part, content, r); err != nil {
+                return err
+            }
+        }
+        return mw.Close()
+    default:
+        _, err = io.CopyN(w, content, size)
+        return err
+    }
+}
+
+// requestedRanges returns the ranges to send, or none for a full response
+func requestedRanges(w *Writer, req *request.Request, modtime time.Time, size int64) ([]httpRange, error) {
+    rangeHeader, found := req.Headers.Get("Range")
+    if !found || req.RequestLine.Method != "GET" || !ifRangeMatches(w, req, modtime) {
+        return nil, nil
+    }
+    ranges, err := parseRange(rangeHeader, size)
+    if err != nil {
+        if errors.Is(err, errNoOverlap) {
+            return nil, err
+        }
+        return nil, nil
+    }
+    // NOTE: asking for more than the whole content is either a broken or a
+    // hostile client, the whole content is cheaper for both
+    if sumLength(ranges) > size {
+        return nil, nil
+    }
+    return ranges, nil
+}
+
+// ifRangeMatches evaluates If-Range (RFC 9110 13.1.5). It holds when the
+// header is absent, or names the current ETag, strongly compared, or the
+// exact modification time.
+func ifRangeMatches(w *Writer, req *request.Request, modtime time.Time) bool {
+    ifRange, found := req.Headers.Get("If-Range")
+    if !found {
+        return true
+    }
+    if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+        etag, found := w.Header().Get("ETag")
+        return found && etagsMatch(ifRange, etag, false)
+    }
+    t, err := http.ParseTime(ifRange)
+    return err == nil && !modtime.IsZero() && t.Equal(modtime.Truncate(time.Second))
+}
+
+func copyRange(dst io.Writer, content io.ReadSeeker, r httpRange) error {
+    if _, err := content.Seek(r.start, io.SeekStart); err != nil {
+        return err
+    }
+    _, err := io.CopyN(dst, content, r.length)
+    return err
+}
+
+// detectContentType picks the Content-Type for content, leaving it
+// positioned at the start
+func detectContentType(w *Writer, name string, content io.ReadSeeker) (string, error) {
+    if ct, found := w.Header().Get("Content-Type"); found {
+        return ct, nil
+    }
+    if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+        return ct, nil
+    }
+    buf := make([]byte, sniffLen)
+    n, err := io.ReadFull(content, buf)
+    if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+        return "", err
+    }
+    if _, err := content.Seek(0, io.SeekStart); err != nil {
+        return "", err
+    }
+    return http.DetectContentType(buf[:n]), nil
+}
@@ -0,0 +1,158 @@
+package response
+
+import (
+    "bytes"
+    "io"
+    "mime"
+    "mime/multipart"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+)
+
+// serveContent runs ServeContent for a request with the given extra header
+// lines and returns the raw response
+func serveContent(t *testing.T, method, headerLines string, modtime time.Time, content string, setup ...func(w *Writer)) string {
+    t.Helper()
+    req, err := request.RequestFromReader(strings.NewReader(method + " /file HTTP/1.1\r\nHost: localhost\r\n" + headerLines + "\r\n"))
+    require.NoError(t, err)
+    buf := &bytes.Buffer{}
+    w := NewWriter(buf)
+    w.SetKeepAlive(true)
+    for _, fn := range setup {
+        fn(w)
+    }
+    require.NoError(t, ServeContent(w, req, "file.txt", modtime, strings.NewReader(content)))
+    return buf.String()
+}
+
+func TestParseRange(t *testing.T) {
+    tests := []struct {
+        header string
+        want   []httpRange
+        err    error
+    }{
+        {"bytes=0-4", []httpRange{{0, 5}}, nil},
+        {"bytes=5-", []httpRange{{5, 5}}, nil},
+        {"bytes=-3", []httpRange{{7, 3}}, nil},
+        {"bytes=-30", []httpRange{{0, 10}}, nil},
+        {"bytes=8-20", []httpRange{{8, 2}}, nil},
+        {"bytes=0-0, 2-3,,", []httpRange{{0, 1}, {2, 2}}, nil},
+        {"bytes=0-1, 20-30", []httpRange{{0, 2}}, nil},
+        {"bytes=10-", nil, errNoOverlap},
+        {"bytes=-0", nil, errNoOverlap},
+        {"bytes=5-2", nil, errInvalidRange},
+        {"bytes=a-b", nil, errInvalidRange},
+        {"bytes=+1-2", nil, errInvalidRange},
+        {"bytes=", nil, errInvalidRange},
+        {"items=0-1", nil, errInvalidRange},
+        {"0-1", nil, errInvalidRange},
+    }
+    for _, tt := range tests {
+        got, err := parseRange(tt.header, 10)
+        assert.Equal(t, tt.err, err, tt.header)
+        assert.Equal(t, tt.want, got, tt.header)
+    }
+}
+
+func TestServeContentRanges(t *testing.T) {
+    const content = "0123456789"
+    modtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+    // TEST: Full response advertises ranges
+    out := serveContent(t, "GET", "", modtime, content)
+    assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+        "Accept-Ranges: bytes\r\n"+
+        "Content-Type: text/plain; charset=utf-8\r\n"+
+        "Content-Length: 10\r\n"+
+        "Last-Modified: Wed, 01 May 2024 12:00:00 GMT\r\n"+
+        "\r\n"+
+        content, out)
+
+    // TEST: Single range
+    out = serveContent(t, "GET", "Range: bytes=2-5\r\n", modtime, content)
+    assert.Equal(t, "HTTP/1.1 206 Partial Content\r\n"+
+        "Accept-Ranges: bytes\r\n"+
+        "Content-Range: bytes 2-5/10\r\n"+
+        "Content-Type: text/plain; charset=utf-8\r\n"+
+        "Content-Length: 4\r\n"+
+        "Last-Modified: Wed, 01 May 2024 12:00:00 GMT\r\n"+
+        "\r\n"+
+        "2345", out)
+
+    // TEST: Suffix range
+    out = serveContent(t, "GET", "Range: bytes=-3\r\n", modtime, content)
+    assert.Contains(t, out, "\r\nContent-Range: bytes 7-9/10\r\n")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\n789"), out)
+
+    // TEST: Multiple ranges as multipart/byteranges
+    out = serveContent(t, "GET", "Range: bytes=0-1, 8-\r\n", modtime, content)
+    head, body, _ := strings.Cut(out, "\r\n\r\n")
+    assert.True(t, strings.HasPrefix(head, "HTTP/1.1 206 Partial Content\r\n"), head)
+    assert.Equal(t, strconv.Itoa(len(body)), value(head, "Content-Length"))
+    _, params, err := mime.ParseMediaType(value(head, "Content-Type"))
+    require.NoError(t, err)
+    mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+    for _, want := range []struct{ contentRange, data string }{
+        {"bytes 0-1/10", "01"},
+        {"bytes 8-9/10", "89"},
+    } {
+        part, err := mr.NextPart()
+        require.NoError(t, err)
+        assert.Equal(t, want.contentRange, part.Header.Get("Content-Range"))
+        assert.Equal(t, "text/plain; charset=utf-8", part.Header.Get("Content-Type"))
+        data, err := io.ReadAll(part)
+        require.NoError(t, err)
+        assert.Equal(t, want.data, string(data))
+    }
+    _, err = mr.NextPart()
+    assert.Equal(t, io.EOF, err)
+
+    // TEST: Unsatisfiable range
+    out = serveContent(t, "GET", "Range: bytes=20-\r\n", modtime, content)
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 416 Range Not Satisfiable\r\n"), out)
+    assert.Contains(t, out, "\r\nContent-Range: bytes */10\r\n")
+
+    // TEST: Malformed ranges and ranges adding up past the content are ignored
+    for _, header := range []string{"Range: bytes=5-2\r\n", "Range: bytes=0-8, 1-9\r\n"} {
+        out = serveContent(t, "GET", header, modtime, content)
+        assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+    }
+
+    // TEST: Range only applies to GET
+    out = serveContent(t, "HEAD", "Range: bytes=2-5\r\n", modtime, content)
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+
+    // TEST: If-Range with the modification time
+    out = serveContent(t, "GET", "Range: bytes=2-5\r\nIf-Range: Wed, 01 May 2024 12:00:00 GMT\r\n", modtime, content)
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 Partial Content\r\n"), out)
+    out = serveContent(t, "GET", "Range: bytes=2-5\r\nIf-Range: Tue, 30 Apr 2024 12:00:00 GMT\r\n", modtime, content)
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+
+    // TEST: If-Range with an entity tag, strongly compared
+    withETag := func(etag string) func(w *Writer) {
+        return func(w *Writer) { w.Header().Set("ETag", etag) }
+    }
+    out = serveContent(t, "GET", "Range: bytes=2-5\r\nIf-Range: \"v1\"\r\n", modtime, content, withETag(`"v1"`))
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 206 Partial Content\r\n"), out)
+    out = serveContent(t, "GET", "Range: bytes=2-5\r\nIf-Range: \"v1\"\r\n", modtime, content, withETag(`"v2"`))
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+    out = serveContent(t, "GET", "Range: bytes=2-5\r\nIf-Range: W/\"v1\"\r\n", modtime, content, withETag(`W/"v1"`))
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+}
+
+// value returns the value of the header line named key in head
+func value(head, key string) string {
+    for _, line := range strings.Split(head, "\r\n") {
+        if k, v, found := strings.Cut(line, ": "); found && k == key {
+            return v
+        }
+    }
+    return ""
+}
@@ -0,0 +1,140 @@
+package response
+
+import (
+    "errors"
+    "fmt"
+    "mime/multipart"
+    "net/textproto"
+    "strconv"
+    "strings"
+)
+
+var (
+    // errInvalidRange means the Range header is malformed and, as RFC 9110
+    // 14.2 asks, must be ignored
+    errInvalidRange = errors.New("invalid range")
+    // errNoOverlap means none of the ranges overlap the content, which
+    // gets a 416 Range Not Satisfiable
+    errNoOverlap = errors.New("no range overlaps the content")
+)
+
+// httpRange is the byte range [start, start+length) of the content
+type httpRange struct {
+    start  int64
+    length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+    return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header value (RFC 9110 14.1.2) for content of
+// size bytes. Ranges reaching past the end are cut short, ranges starting
+// past it are dropped.
+func parseRange(s string, size int64) ([]httpRange, error) {
+    unit, set, found := strings.Cut(s, "=")
+    if !found || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+        return nil, errInvalidRange
+    }
+
+    var ranges []httpRange
+    noOverlap := false
+    for _, spec := range strings.Split(set, ",") {
+        spec = strings.TrimSpace(spec)
+        if spec == "" {
+            continue
+        }
+        first, last, found := strings.Cut(spec, "-")
+        if !found {
+            return nil, errInvalidRange
+        }
+
+        if first == "" {
+            // NOTE: suffix range, the last n bytes
+            n, err := parseRangeInt(last)
+            if err != nil {
+                return nil, errInvalidRange
+            }
+            if n == 0 || size == 0 {
+                noOverlap = true
+                continue
+            }
+            n = min(n, size)
+            ranges = append(ranges, httpRange{start: size - n, length: n})
+            continue
+        }
+
+        start, err := parseRangeInt(first)
+        if err != nil {
+            return nil, errInvalidRange
+        }
+        end := size - 1
+        if last != "" {
+            end, err = parseRangeInt(last)
+            if err != nil || end < start {
+                return nil, errInvalidRange
+            }
+            end = min(end, size-1)
+        }
+        if start >= size {
+            noOverlap = true
+            continue
+        }
+        ranges = append(ranges, httpRange{start: start, length: end - start + 1})
+    }
+
+    if len(ranges) == 0 {
+        if noOverlap {
+            return nil, errNoOverlap
+        }
+        return nil, errInvalidRange
+    }
+    return ranges, nil
+}
+
+// parseRangeInt parses a non-negative decimal without sign or spaces
+func parseRangeInt(s string) (int64, error) {
+    if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+        return 0, errInvalidRange
+    }
+    return strconv.ParseInt(s, 10, 64)
+}
+
+// sumLength returns the number of bytes covered by ranges, counting
+// overlapping bytes more than once
+func sumLength(ranges []httpRange) int64 {
+    var total int64
+    for _, r := range ranges {
+        total += r.length
+    }
+    return total
+}
+
+// rangePartHeader returns the header of a multipart/byteranges part
+func rangePartHeader(r httpRange, contentType string, size int64) textproto.MIMEHeader {
+    return textproto.MIMEHeader{
+        "Content-Type":  {contentType},
+        "Content-Range": {r.contentRange(size)},
+    }
+}
+
+// multipartSize returns the length of the multipart/byteranges body
+// written for ranges with boundary, so it can be sent as Content-Length
+func multipartSize(ranges []httpRange, boundary, contentType string, size int64) int64 {
+    var cw countingWriter
+    mw := multipart.NewWriter(&cw)
+    mw.SetBoundary(boundary)
+    for _, r := range ranges {
+        mw.CreatePart(rangePartHeader(r, contentType, size))
+        cw += countingWriter(r.length)
+    }
+    mw.Close()
+    return int64(cw)
+}
+
+type countingWriter int64
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+    *cw += countingWriter(len(p))
+    return len(p), nil
+}
@@ -1,6 +1,7 @@
 package response
 
 import (
+    "fmt"
     "io"
     "log"
     "strconv"
@@ -8,26 +9,14 @@ import (
     "github.com/mrtuuro/http-from-tcp/internal/headers"
 )
 
-type StatusCode int
-
-const (
-    StatusOK                  StatusCode = 200
-    StatusBadRequest          StatusCode = 400
-    StatusInternalServerError StatusCode = 500
-)
-
-func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-    reasonPhraseMap := map[StatusCode]string{
-        200: "HTTP/1.1 200 OK\r\n",
-        400: "HTTP/1.1 400 Bad Request\r\n",
-        500: "HTTP/1.1 500 Internal Server Error\r\n",
-    }
-
-    reasonPhrase, ok := reasonPhraseMap[statusCode]
-    if !ok {
-        reasonPhrase = "\r\n"
+// WriteStatusLine writes the status line for statusCode. An optional
+// reason replaces the registered reason phrase.
+func WriteStatusLine(w io.Writer, statusCode StatusCode, reason ...string) error {
+    line, err := statusLine(statusCode, reason...)
+    if err != nil {
+        return err
     }
-    _, err := w.Write([]byte(reasonPhrase))
+    _, err = w.Write(line)
     if err != nil {
         log.Printf("Error writing reason phrase: %v", err)
         return err
@@ -35,10 +24,30 @@ func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
     return nil
 }
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
+func GetDefaultHeaders(contentLen int) *headers.Headers {
     defHeaders := headers.NewHeaders()
     defHeaders.Set("Content-Length", strconv.Itoa(contentLen))
-    defHeaders.Set("Connection", "close")
     defHeaders.Set("Content-Type", "text/plain")
     return defHeaders
 }
+
+// WriteStatus sends a complete plain text response made of the status code
+// and its reason phrase, plus any extra headers
+func WriteStatus(w *Writer, statusCode StatusCode, extra *headers.Headers) error {
+    body := []byte(fmt.Sprintf("%d %s", statusCode, StatusText(statusCode)))
+    if err := w.WriteStatusLine(statusCode); err != nil {
+        return err
+    }
+    h := GetDefaultHeaders(len(body))
+    if extra != nil {
+        extra.Range(func(k, v string) bool {
+            h.Add(k, v)
+            return true
+        })
+    }
+    if err := w.WriteHeaders(h); err != nil {
+        return err
+    }
+    _, err := w.WriteBody(body)
+    return err
+}
@@ -0,0 +1,341 @@
+package response
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/mrtuuro/http-from-tcp/internal/headers"
+)
+
+func TestWriteStatusLine(t *testing.T) {
+    // TEST: Registered status code
+    buf := &bytes.Buffer{}
+    err := WriteStatusLine(buf, StatusNotFound)
+    require.NoError(t, err)
+    assert.Equal(t, "HTTP/1.1 404 Not Found\r\n", buf.String())
+
+    // TEST: Custom reason phrase
+    buf.Reset()
+    err = WriteStatusLine(buf, StatusTooManyRequests, "Slow Down")
+    require.NoError(t, err)
+    assert.Equal(t, "HTTP/1.1 429 Slow Down\r\n", buf.String())
+
+    // TEST: Unregistered code keeps an empty reason phrase
+    buf.Reset()
+    err = WriteStatusLine(buf, 299)
+    require.NoError(t, err)
+    assert.Equal(t, "HTTP/1.1 299 \r\n", buf.String())
+
+    // TEST: Code out of range
+    buf.Reset()
+    err = WriteStatusLine(buf, 42)
+    require.Error(t, err)
+    assert.Empty(t, buf.String())
+
+    // TEST: Reason phrase with CRLF
+    err = WriteStatusLine(buf, StatusOK, "OK\r\nX-Injected: yes")
+    require.Error(t, err)
+    assert.Empty(t, buf.String())
+
+    // TEST: Writer uses the same registry
+    buf.Reset()
+    w := NewWriter(buf)
+    err = w.WriteStatusLine(StatusNoContent)
+    require.NoError(t, err)
+    assert.Equal(t, "HTTP/1.1 204 No Content\r\n", buf.String())
+
+    // TEST: Writer rejects an invalid code and stays in the status line state
+    buf.Reset()
+    w = NewWriter(buf)
+    err = w.WriteStatusLine(1000)
+    require.Error(t, err)
+    err = w.WriteStatusLine(StatusCreated, "Made It")
+    require.NoError(t, err)
+    assert.Equal(t, "HTTP/1.1 201 Made It\r\n", buf.String())
+}
+
+func TestWriteHeaders(t *testing.T) {
+    // TEST: Headers are written in insertion order with their casing
+    buf := &bytes.Buffer{}
+    w := NewWriter(buf)
+    w.SetKeepAlive(true)
+    require.NoError(t, w.WriteStatusLine(StatusOK))
+    h := GetDefaultHeaders(0)
+    h.Add("Set-Cookie", "a=1")
+    h.Add("Set-Cookie", "b=2")
+    h.Add("X-Request-ID", "42")
+    require.NoError(t, w.WriteHeaders(h))
+    assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+        "Content-Length: 0\r\n"+
+        "Content-Type: text/plain\r\n"+
+        "Set-Cookie: a=1\r\n"+
+        "Set-Cookie: b=2\r\n"+
+        "X-Request-ID: 42\r\n"+
+        "\r\n", buf.String())
+
+    // TEST: Closing connections replace the handler's Connection header
+    buf.Reset()
+    w = NewWriter(buf)
+    require.NoError(t, w.WriteStatusLine(StatusOK))
+    h = GetDefaultHeaders(0)
+    h.Set("Connection", "keep-alive")
+    require.NoError(t, w.WriteHeaders(h))
+    assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+        "Content-Length: 0\r\n"+
+        "Content-Type: text/plain\r\n"+
+        "Connection: close\r\n"+
+        "\r\n", buf.String())
+    v, _ := h.Get("Connection")
+    assert.Equal(t, "keep-alive", v)
+
+    // TEST: Writer headers are merged, the handler's own fields win
+    buf.Reset()
+    w = NewWriter(buf)
+    w.SetKeepAlive(true)
+    w.Header().Set("X-Request-ID", "from-middleware")
+    w.Header().Set("Content-Type", "application/json")
+    require.NoError(t, w.WriteStatusLine(StatusOK))
+    require.NoError(t, w.WriteHeaders(GetDefaultHeaders(0)))
+    assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+        "Content-Length: 0\r\n"+
+        "Content-Type: text/plain\r\n"+
+        "X-Request-ID: from-middleware\r\n"+
+        "\r\n", buf.String())
+    assert.Equal(t, StatusOK, w.StatusCode())
+}
+
+func TestChunkedTrailers(t *testing.T) {
+    chunked := func(buf *bytes.Buffer, trailer string) *Writer {
+        w := NewWriter(buf)
+        w.SetKeepAlive(true)
+        require.NoError(t, w.WriteStatusLine(StatusOK))
+        h := headers.NewHeaders()
+        h.Set("Transfer-Encoding", "chunked")
+        if trailer != "" {
+            h.Set("Trailer", trailer)
+        }
+        require.NoError(t, w.WriteHeaders(h))
+        _, err := w.WriteChunkedBody([]byte("hello"))
+        require.NoError(t, err)
+        return w
+    }
+
+    // TEST: Trailers end the response
+    buf := &bytes.Buffer{}
+    w := chunked(buf, "X-Checksum, X-Length")
+    _, err := w.WriteChunkedBodyDone()
+    require.NoError(t, err)
+    trailers := headers.NewHeaders()
+    trailers.Set("X-Checksum", "abc")
+    require.NoError(t, w.WriteTrailers(trailers))
+    assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+        "Transfer-Encoding: chunked\r\n"+
+        "Trailer: X-Checksum, X-Length\r\n"+
+        "\r\n"+
+        "5\r\nhello\r\n"+
+        "0\r\n"+
+        "X-Checksum: abc\r\n"+
+        "\r\n", buf.String())
+    assert.True(t, w.KeepAlive())
+
+    // TEST: Nothing can be written once the response is done
+    _, err = w.WriteChunkedBody([]byte("more"))
+    assert.Error(t, err)
+    _, err = w.WriteBody([]byte("more"))
+    assert.Error(t, err)
+    assert.Error(t, w.WriteTrailers(headers.NewHeaders()))
+    assert.NoError(t, w.Close())
+
+    // TEST: Close ends a chunked body without trailers
+    buf = &bytes.Buffer{}
+    w = chunked(buf, "")
+    assert.False(t, w.KeepAlive())
+    require.NoError(t, w.Close())
+    assert.True(t, strings.HasSuffix(buf.String(), "5\r\nhello\r\n0\r\n\r\n"), buf.String())
+    assert.True(t, w.KeepAlive())
+
+    // TEST: WriteTrailers writes the last chunk itself
+    buf = &bytes.Buffer{}
+    w = chunked(buf, "X-Checksum")
+    require.NoError(t, w.WriteTrailers(trailers))
+    assert.True(t, strings.HasSuffix(buf.String(), "5\r\nhello\r\n0\r\nX-Checksum: abc\r\n\r\n"), buf.String())
+
+    // TEST: Trailers must be announced
+    w = chunked(&bytes.Buffer{}, "X-Length")
+    assert.Error(t, w.WriteTrailers(trailers))
+
+    // TEST: Fields that frame or route the message can't be trailers
+    w = chunked(&bytes.Buffer{}, "Content-Length")
+    trailers = headers.NewHeaders()
+    trailers.Set("Content-Length", "5")
+    assert.Error(t, w.WriteTrailers(trailers))
+}
+
+func TestClose(t *testing.T) {
+    // TEST: Complete Content-Length body
+    w := NewWriter(&bytes.Buffer{})
+    require.NoError(t, w.WriteStatusLine(StatusOK))
+    require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+    _, err := w.WriteBody([]byte("hello"))
+    require.NoError(t, err)
+    assert.NoError(t, w.Close())
+    _, err = w.WriteBody([]byte("more"))
+    assert.Error(t, err)
+
+    // TEST: Short Content-Length body
+    w = NewWriter(&bytes.Buffer{})
+    require.NoError(t, w.WriteStatusLine(StatusOK))
+    require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+    _, err = w.WriteBody([]byte("hel"))
+    require.NoError(t, err)
+    assert.Error(t, w.Close())
+
+    // TEST: HEAD responses have no body to complete
+    w = NewWriter(&bytes.Buffer{})
+    w.SetDiscardBody(true)
+    require.NoError(t, w.WriteStatusLine(StatusOK))
+    require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+    assert.NoError(t, w.Close())
+
+    // TEST: Nothing written yet is an empty 200
+    buf := &bytes.Buffer{}
+    w = NewWriter(buf)
+    w.SetKeepAlive(true)
+    require.NoError(t, w.Close())
+    assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", buf.String())
+    assert.True(t, w.KeepAlive())
+    assert.Equal(t, StatusOK, w.StatusCode())
+
+    // TEST: A status line without headers can't be closed
+    w = NewWriter(&bytes.Buffer{})
+    require.NoError(t, w.WriteStatusLine(StatusOK))
+    assert.Error(t, w.Close())
+}
+
+func TestAutoFraming(t *testing.T) {
+    // TEST: Short bodies get a Content-Length and a sniffed Content-Type
+    buf := &bytes.Buffer{}
+    w := NewWriter(buf)
+    w.SetKeepAlive(true)
+    w.Header().Set("X-Request-ID", "42")
+    n, err := w.Write([]byte("<!DOCTYPE html>"))
+    require.NoError(t, err)
+    assert.Equal(t, 15, n)
+    w.Write([]byte("<p>hi</p>"))
+    assert.Equal(t, "", buf.String())
+    assert.Equal(t, StatusOK, w.StatusCode())
+    assert.Equal(t, int64(24), w.BytesWritten())
+    require.NoError(t, w.Close())
+    assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+        "Content-Type: text/html; charset=utf-8\r\n"+
+        "Content-Length: 24\r\n"+
+        "X-Request-ID: 42\r\n"+
+        "\r\n"+
+        "<!DOCTYPE html><p>hi</p>", buf.String())
+    assert.True(t, w.KeepAlive())
+
+    // TEST: Long bodies switch to chunked
+    buf = &bytes.Buffer{}
+    w = NewWriter(buf)
+    w.SetKeepAlive(true)
+    w.Header().Set("Content-Type", "text/plain")
+    w.WriteHeader(StatusCreated)
+    long := strings.Repeat("a", autoBufferSize+1)
+    _, err = w.Write([]byte(long))
+    require.NoError(t, err)
+    _, err = w.Write([]byte("tail"))
+    require.NoError(t, err)
+    require.NoError(t, w.Close())
+    assert.Equal(t, "HTTP/1.1 201 Created\r\n"+
+        "Transfer-Encoding: chunked\r\n"+
+        "Content-Type: text/plain\r\n"+
+        "\r\n"+
+        "1001\r\n"+long+"\r\n"+
+        "4\r\ntail\r\n"+
+        "0\r\n\r\n", buf.String())
+    assert.True(t, w.KeepAlive())
+
+    // TEST: Empty writes don't end a chunked body
+    buf = &bytes.Buffer{}
+    w = NewWriter(buf)
+    w.SetKeepAlive(true)
+    w.Header().Set("Content-Type", "text/plain")
+    w.Write([]byte(long))
+    n, err = w.Write(nil)
+    require.NoError(t, err)
+    assert.Equal(t, 0, n)
+    n, err = w.WriteChunkedBody([]byte{})
+    require.NoError(t, err)
+    assert.Equal(t, 0, n)
+    w.Write([]byte("ZZZ"))
+    require.NoError(t, w.Close())
+    assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n1001\r\n"+long+"\r\n3\r\nZZZ\r\n0\r\n\r\n"), buf.String())
+    assert.True(t, w.KeepAlive())
+
+    // TEST: Flush sends what's held back
+    buf = &bytes.Buffer{}
+    w = NewWriter(buf)
+    w.Header().Set("Content-Type", "text/plain")
+    w.Write([]byte("event"))
+    require.NoError(t, w.Flush())
+    assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n5\r\nevent\r\n"), buf.String())
+
+    // TEST: WriteHeader without a body
+    buf = &bytes.Buffer{}
+    w = NewWriter(buf)
+    w.SetKeepAlive(true)
+    w.WriteHeader(StatusNoContent)
+    w.WriteHeader(StatusOK)
+    _, err = w.Write([]byte("body"))
+    assert.ErrorIs(t, err, ErrBodyNotAllowed)
+    require.NoError(t, w.Close())
+    assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", buf.String())
+    assert.True(t, w.KeepAlive())
+
+    // TEST: Overruns of a declared length fail while the body is held back
+    buf = &bytes.Buffer{}
+    w = NewWriter(buf)
+    w.Header().Set("Content-Length", "5")
+    _, err = w.Write([]byte("0123456789"))
+    assert.ErrorIs(t, err, ErrContentLength)
+    assert.Equal(t, "", buf.String())
+    n, err = w.Write([]byte("01234"))
+    require.NoError(t, err)
+    assert.Equal(t, 5, n)
+    _, err = w.Write([]byte("5"))
+    assert.ErrorIs(t, err, ErrContentLength)
+    require.NoError(t, w.Close())
+    assert.True(t, strings.HasSuffix(buf.String(), "Content-Length: 5\r\nConnection: close\r\n\r\n01234"), buf.String())
+
+    // TEST: Declared length, overrun and underrun
+    buf = &bytes.Buffer{}
+    w = NewWriter(buf)
+    w.Header().Set("Content-Length", "5")
+    w.Write([]byte("hel"))
+    require.NoError(t, w.Flush())
+    _, err = w.Write([]byte("lo!"))
+    assert.ErrorIs(t, err, ErrContentLength)
+    assert.Error(t, w.Close())
+    _, err = w.Write([]byte("lo"))
+    require.NoError(t, err)
+    require.NoError(t, w.Close())
+    assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+        "Content-Type: text/plain; charset=utf-8\r\n"+
+        "Content-Length: 5\r\n"+
+        "Connection: close\r\n"+
+        "\r\n"+
+        "hello", buf.String())
+
+    // TEST: Overrun with the explicit calls
+    w = NewWriter(&bytes.Buffer{})
+    w.WriteStatusLine(StatusOK)
+    w.WriteHeaders(GetDefaultHeaders(2))
+    _, err = w.WriteBody([]byte("abc"))
+    assert.ErrorIs(t, err, ErrContentLength)
+    _, err = w.Write([]byte("ab"))
+    assert.NoError(t, err)
+}
@@ -1,12 +1,35 @@
 package response
 
 import (
+    "bufio"
+    "cmp"
+    "errors"
     "fmt"
     "io"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
 
     "github.com/mrtuuro/http-from-tcp/internal/headers"
 )
 
+// ErrContentLength is returned for body writes past the declared
+// Content-Length
+var ErrContentLength = errors.New("response: wrote more than the declared Content-Length")
+
+// ErrBodyNotAllowed is returned for body writes to 1xx, 204 and 304
+// responses
+var ErrBodyNotAllowed = errors.New("response: status does not allow a body")
+
+// ErrNotHijackable is returned by Hijack on writers not backed by a
+// connection the server can hand over
+var ErrNotHijackable = errors.New("response: connection cannot be hijacked")
+
+// autoBufferSize is how much Write holds back before it has to pick the
+// framing, bodies that fit are sent with a Content-Length
+const autoBufferSize = 4 << 10
+
 type state int
 
 const (
@@ -14,69 +37,256 @@ const (
     writerStateHeaders
     writerStateBody
     writerStateTrailers
+    // NOTE: the response is complete, nothing more can be written
+    writerStateDone
 )
 
 type Writer struct {
     writer io.Writer
     state  state
+
+    statusCode StatusCode
+    header     *headers.Headers
+
+    // NOTE: framing bookkeeping used to decide whether the connection can
+    // be reused once the handler is done
+    keepAlive     bool
+    contentLength int64
+    chunked       bool
+    bodyWritten   int64
+    // trailer is the Trailer header field sent, the fields WriteTrailers
+    // may send
+    trailer string
+
+    // NOTE: responses to HEAD carry the headers of the GET response
+    // but no body
+    discardBody bool
+
+    // NOTE: content coding negotiated by EnableCompression, encoded is
+    // set once the body is actually compressed
+    compression *Compression
+    coding      string
+    encoded     bool
+    encoder     encoder
+
+    // NOTE: net/http style writes, the status and body held back until
+    // the framing is known
+    pending       bool
+    pendingStatus StatusCode
+    pendingBody   []byte
+
+    hijacker func() (net.Conn, *bufio.ReadWriter, error)
 }
 
 func NewWriter(w io.Writer) *Writer {
     return &Writer{
-        writer: w,
-        state:  writerStateStatusLine,
+        writer:        w,
+        state:         writerStateStatusLine,
+        contentLength: -1,
     }
 }
 
-func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
-    if w.state != writerStateStatusLine {
-        return fmt.Errorf("cannot write status line in state %d", w.state)
+// SetKeepAlive tells the writer whether the server intends to reuse the
+// connection. When false, WriteHeaders announces "Connection: close".
+// Writers start out with keep-alive disabled.
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+    w.keepAlive = keepAlive
+}
+
+// SetDiscardBody makes the writer drop body bytes, and chunk framing,
+// instead of sending them, as is required when answering HEAD. Headers
+// such as Content-Length are still sent as the handler wrote them.
+func (w *Writer) SetDiscardBody(discard bool) {
+    w.discardBody = discard
+}
+
+// Header returns headers sent along with every response from this writer.
+// They are merged into the headers passed to WriteHeaders, where fields
+// the handler set itself take precedence, so middleware can add fields
+// like X-Request-ID without the handler knowing.
+func (w *Writer) Header() *headers.Headers {
+    if w.header == nil {
+        w.header = headers.NewHeaders()
     }
+    return w.header
+}
 
-    defer func() { w.state = writerStateHeaders }()
+// StatusCode returns the status code sent, or 0 before the status line.
+// The status of a response Write is still holding back counts as sent.
+func (w *Writer) StatusCode() StatusCode {
+    if w.pending {
+        return cmp.Or(w.pendingStatus, StatusOK)
+    }
+    return w.statusCode
+}
+
+// BytesWritten returns the number of body bytes the handler has written,
+// not counting chunk framing
+func (w *Writer) BytesWritten() int64 {
+    return w.bodyWritten + int64(len(w.pendingBody))
+}
+
+// KeepAlive reports whether another response can follow this one on the
+// same connection: keep-alive was requested, the handler did not send
+// "Connection: close" and the body was completely and correctly framed.
+func (w *Writer) KeepAlive() bool {
+    if !w.keepAlive || w.state == writerStateStatusLine || w.state == writerStateHeaders {
+        return false
+    }
+    if w.discardBody {
+        return true
+    }
+    if w.chunked {
+        return w.state == writerStateDone
+    }
+    return w.bodyWritten == w.contentLength
+}
 
-    reasonPhraseMap := map[StatusCode]string{
-        200: "HTTP/1.1 200 OK\r\n",
-        400: "HTTP/1.1 400 Bad Request\r\n",
-        500: "HTTP/1.1 500 Internal Server Error\r\n",
+// WriteStatusLine writes the status line. Any three-digit code is
+// accepted; an optional reason replaces the registered reason phrase.
+func (w *Writer) WriteStatusLine(statusCode StatusCode, reason ...string) error {
+    if w.state != writerStateStatusLine {
+        return fmt.Errorf("cannot write status line in state %d", w.state)
     }
 
-    reasonPhrase, ok := reasonPhraseMap[statusCode]
-    if !ok {
-        reasonPhrase = "\r\n"
+    line, err := statusLine(statusCode, reason...)
+    if err != nil {
+        return err
     }
-    _, err := w.writer.Write([]byte(reasonPhrase))
+    defer func() { w.state = writerStateHeaders }()
+    w.statusCode = statusCode
+    // NOTE: a handler going back to the explicit calls, like the panic
+    // handler answering 500, throws away what Write held back
+    w.pending, w.pendingStatus, w.pendingBody = false, 0, nil
+
+    _, err = w.writer.Write(line)
     return err
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
+// WriteHeaders writes the header section, field lines in the order they
+// were added
+func (w *Writer) WriteHeaders(headers *headers.Headers) error {
     if w.state != writerStateHeaders {
         return fmt.Errorf("cannot write headers in state %d", w.state)
     }
+    headers = w.mergeHeader(headers)
+    if err := headers.Validate(); err != nil {
+        return err
+    }
     defer func() { w.state = writerStateBody }()
 
-    for k, v := range headers {
-        headerData := []byte(fmt.Sprintf("%s: %s\r\n", k, v))
-        _, err := w.writer.Write(headerData)
-        if err != nil {
-            return err
-        }
+    w.inspectFraming(headers)
+    w.trailer, _ = headers.Get("Trailer")
+    headers = w.startCompression(headers)
+    if !w.keepAlive {
+        headers = headers.Clone()
+        headers.Set("Connection", "close")
     }
-    _, err := w.writer.Write([]byte("\r\n"))
+    _, err := headers.WriteTo(w.writer)
+    if err != nil {
+        return err
+    }
+    _, err = w.writer.Write([]byte("\r\n"))
     return err
 }
 
+// mergeHeader adds the fields of w.Header whose names are not in h. h
+// itself is left untouched.
+func (w *Writer) mergeHeader(h *headers.Headers) *headers.Headers {
+    if w.header == nil || w.header.Len() == 0 {
+        return h
+    }
+    merged := h.Clone()
+    w.header.Range(func(k, v string) bool {
+        if _, found := h.Get(k); !found {
+            merged.Add(k, v)
+        }
+        return true
+    })
+    return merged
+}
+
+// inspectFraming records how the body is delimited, dropping keep-alive
+// when the handler asked to close or the body length can't be determined
+func (w *Writer) inspectFraming(h *headers.Headers) {
+    if conn, found := h.Get("Connection"); found && hasToken(conn, "close") {
+        w.keepAlive = false
+    }
+    if !bodyAllowed(w.statusCode) {
+        w.contentLength = 0
+        return
+    }
+    if te, found := h.Get("Transfer-Encoding"); found && hasToken(te, "chunked") {
+        w.chunked = true
+        return
+    }
+    if cl, found := h.Get("Content-Length"); found {
+        n, err := strconv.ParseInt(cl, 10, 64)
+        if err == nil && n >= 0 {
+            w.contentLength = n
+            return
+        }
+    }
+    // NOTE: without a length the body can only end with the connection
+    w.keepAlive = false
+}
+
+// hasToken reports whether the comma separated list contains token
+func hasToken(list, token string) bool {
+    for _, t := range strings.Split(list, ",") {
+        if strings.EqualFold(strings.TrimSpace(t), token) {
+            return true
+        }
+    }
+    return false
+}
+
 func (w *Writer) WriteBody(p []byte) (int, error) {
     if w.state != writerStateBody {
         return 0, fmt.Errorf("cannow write body in state %d", w.state)
     }
-    return w.writer.Write(p)
+    if !w.chunked && len(p) > 0 {
+        if !bodyAllowed(w.statusCode) {
+            return 0, ErrBodyNotAllowed
+        }
+        if w.contentLength >= 0 && w.bodyWritten+int64(len(p)) > w.contentLength {
+            return 0, ErrContentLength
+        }
+    }
+    if w.discardBody {
+        w.bodyWritten += int64(len(p))
+        return len(p), nil
+    }
+    if w.encoded {
+        return w.writeEncoded(p, false)
+    }
+    n, err := w.writer.Write(p)
+    w.bodyWritten += int64(n)
+    return n, err
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+    return w.writeChunked(p, true)
+}
+
+// writeChunked writes p as one chunk. A compressed body only goes out
+// with the chunk when flush is set, otherwise the encoder holds on to it
+// until it has a block worth sending.
+func (w *Writer) writeChunked(p []byte, flush bool) (int, error) {
     if w.state != writerStateBody {
         return 0, fmt.Errorf("cannot write body in state %d", w.state)
     }
+    // NOTE: an empty chunk would end the body
+    if len(p) == 0 {
+        return 0, nil
+    }
+    if w.encoded {
+        return w.writeEncoded(p, flush)
+    }
+    w.bodyWritten += int64(len(p))
+    if w.discardBody {
+        return len(p), nil
+    }
     chunkSize := len(p)
 
     nTotal := 0
@@ -100,11 +310,19 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
     return nTotal, nil
 }
 
+// WriteChunkedBodyDone writes the last chunk of a chunked body. The
+// response still needs WriteTrailers or Close to end it.
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
     if w.state != writerStateBody {
         return 0, fmt.Errorf("cannot write body in state %d", w.state)
     }
     defer func() { w.state = writerStateTrailers }()
+    if w.discardBody {
+        return 0, nil
+    }
+    if w.encoded {
+        return 0, w.finishEncoding()
+    }
     n, err := w.writer.Write([]byte("0\r\n"))
     if err != nil {
         return n, err
@@ -112,21 +330,233 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
     return n, nil
 }
 
-
-func (w *Writer) WriteTrailers(h headers.Headers) error {
+// WriteTrailers ends a chunked body with the trailer fields h, writing the
+// last chunk first if need be. Every field must be announced in the
+// Trailer header field and be one that is allowed in a trailer.
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
+    if w.state == writerStateBody && w.chunked {
+        if _, err := w.WriteChunkedBodyDone(); err != nil {
+            return err
+        }
+    }
     if w.state != writerStateTrailers {
-        return fmt.Errorf("cannot write headers in state %d", w.state)
+        return fmt.Errorf("cannot write trailers in state %d", w.state)
+    }
+    if err := h.Validate(); err != nil {
+        return err
+    }
+    if err := w.checkTrailers(h); err != nil {
+        return err
+    }
+    defer func() { w.state = writerStateDone }()
+    if w.discardBody {
+        return nil
     }
-    defer func() { w.state = writerStateBody }()
 
-    for k, v := range h {
-        headerData := []byte(fmt.Sprintf("%s: %s\r\n", k, v))
-        fmt.Println(k, v)
-        _, err := w.writer.Write(headerData)
-        if err != nil {
+    if _, err := h.WriteTo(w.writer); err != nil {
+        return err
+    }
+    _, err := w.writer.Write([]byte("\r\n"))
+    return err
+}
+
+// forbiddenTrailers are fields a recipient needs before the content, to
+// frame, route or authenticate the message, so they can't come after it
+// (RFC 9110 6.5.1)
+var forbiddenTrailers = []string{
+    "Authorization", "Cache-Control", "Connection", "Content-Encoding",
+    "Content-Length", "Content-Range", "Content-Type", "Expect", "Host",
+    "Keep-Alive", "Max-Forwards", "Pragma", "Proxy-Authenticate",
+    "Proxy-Authorization", "Proxy-Connection", "Range", "Set-Cookie", "TE",
+    "Trailer", "Transfer-Encoding", "WWW-Authenticate",
+}
+
+// checkTrailers verifies that every field of h was announced and may be
+// sent as a trailer
+func (w *Writer) checkTrailers(h *headers.Headers) error {
+    var err error
+    h.Range(func(k, _ string) bool {
+        for _, forbidden := range forbiddenTrailers {
+            if strings.EqualFold(k, forbidden) {
+                err = fmt.Errorf("%s is not allowed in trailers", k)
+                return false
+            }
+        }
+        if !hasToken(w.trailer, k) {
+            err = fmt.Errorf("trailer %s was not announced in the Trailer header", k)
+            return false
+        }
+        return true
+    })
+    return err
+}
+
+// Close ends the response. Nothing written at all is sent as an empty
+// 200 OK, like net/http does. A chunked body gets its last chunk and an
+// empty trailer section unless WriteTrailers already ended it, any other
+// body has to be complete. Once closed every write fails. The connection
+// itself is left open.
+func (w *Writer) Close() error {
+    if w.state == writerStateStatusLine {
+        if err := w.commit(true); err != nil {
             return err
         }
     }
-    _, err := w.writer.Write([]byte("\r\n"))
+    switch w.state {
+    case writerStateDone:
+        return nil
+    case writerStateHeaders:
+        return fmt.Errorf("cannot close response in state %d", w.state)
+    }
+    if w.chunked {
+        return w.WriteTrailers(headers.NewHeaders())
+    }
+    // NOTE: a compressed body still in the writer is short of its length
+    if !w.discardBody && (w.encoded || w.contentLength >= 0 && w.bodyWritten != w.contentLength) {
+        return fmt.Errorf("cannot close response with %d of %d body bytes written", w.bodyWritten, w.contentLength)
+    }
+    w.state = writerStateDone
+    return nil
+}
+
+// WriteHeader sets the status code sent with the first Write, Flush or
+// Close, the way net/http does. Without it the status is 200 OK. It is
+// ignored once the status line is out.
+func (w *Writer) WriteHeader(statusCode StatusCode) {
+    if w.state != writerStateStatusLine || w.pendingStatus != 0 {
+        return
+    }
+    w.pending = true
+    w.pendingStatus = statusCode
+}
+
+// Write writes body bytes and lets the writer handle the framing. Before
+// the headers are out, the first few KB are held back: a body that ends
+// within them is sent with a Content-Length, a longer one chunked, unless
+// Header has a Content-Length or Transfer-Encoding of its own. A missing
+// Content-Type is sniffed from the held back bytes.
+//
+// After WriteStatusLine and WriteHeaders it writes the body in the framing
+// the handler picked. Declared lengths are enforced, writes past them fail
+// with ErrContentLength and Close fails for bodies that fall short.
+func (w *Writer) Write(p []byte) (int, error) {
+    if w.state == writerStateStatusLine {
+        if w.pendingStatus != 0 && !bodyAllowed(w.pendingStatus) && len(p) > 0 {
+            return 0, ErrBodyNotAllowed
+        }
+        if limit, found := w.declaredLength(); found && int64(len(w.pendingBody)+len(p)) > limit {
+            return 0, ErrContentLength
+        }
+        w.pending = true
+        w.pendingBody = append(w.pendingBody, p...)
+        if len(w.pendingBody) <= autoBufferSize {
+            return len(p), nil
+        }
+        if err := w.commit(false); err != nil {
+            return 0, err
+        }
+        return len(p), nil
+    }
+    if len(p) == 0 {
+        return 0, nil
+    }
+    if w.chunked {
+        if _, err := w.writeChunked(p, false); err != nil {
+            return 0, err
+        }
+        return len(p), nil
+    }
+    return w.WriteBody(p)
+}
+
+// declaredLength returns the Content-Length set in w.Header, unless a
+// Transfer-Encoding overrides it
+func (w *Writer) declaredLength() (int64, bool) {
+    header := w.Header()
+    if _, found := header.Get("Transfer-Encoding"); found {
+        return 0, false
+    }
+    cl, found := header.Get("Content-Length")
+    if !found {
+        return 0, false
+    }
+    n, err := strconv.ParseInt(cl, 10, 64)
+    return n, err == nil && n >= 0
+}
+
+// Flush sends the status line, the headers and whatever Write held back,
+// chunked unless Header has a Content-Length. Later writes go out as they
+// come, except for a compressed body, which the encoder buffers until the
+// next Flush.
+func (w *Writer) Flush() error {
+    if w.state == writerStateStatusLine && w.pending {
+        if err := w.commit(false); err != nil {
+            return err
+        }
+    }
+    if w.state == writerStateBody && w.encoder != nil {
+        return w.encoder.Flush()
+    }
+    return nil
+}
+
+// commit writes the status line and headers for the net/http style writes,
+// followed by the held back body. final means the body is complete.
+func (w *Writer) commit(final bool) error {
+    statusCode := w.pendingStatus
+    if statusCode == 0 {
+        statusCode = StatusOK
+    }
+    body := w.pendingBody
+
+    h := headers.NewHeaders()
+    header := w.Header()
+    if _, found := header.Get("Content-Type"); !found && len(body) > 0 {
+        h.Set("Content-Type", http.DetectContentType(body))
+    }
+    _, hasLength := header.Get("Content-Length")
+    _, hasEncoding := header.Get("Transfer-Encoding")
+    if bodyAllowed(statusCode) && !hasLength && !hasEncoding {
+        if final {
+            h.Set("Content-Length", strconv.Itoa(len(body)))
+        } else {
+            h.Set("Transfer-Encoding", "chunked")
+        }
+    }
+
+    if err := w.WriteStatusLine(statusCode); err != nil {
+        return err
+    }
+    if err := w.WriteHeaders(h); err != nil {
+        return err
+    }
+    if len(body) == 0 {
+        return nil
+    }
+    _, err := w.Write(body)
     return err
 }
+
+// SetHijacker lets the server offer its connection to handlers through
+// Hijack
+func (w *Writer) SetHijacker(hijacker func() (net.Conn, *bufio.ReadWriter, error)) {
+    w.hijacker = hijacker
+}
+
+// Hijack takes the connection over from the server, as protocols that
+// switch away from HTTP need to. The returned reader holds any bytes
+// already read off the connection. The server neither writes, nor closes
+// the connection afterwards, and the writer refuses all writes.
+func (w *Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    if w.hijacker == nil {
+        return nil, nil, ErrNotHijackable
+    }
+    conn, rw, err := w.hijacker()
+    if err != nil {
+        return nil, nil, err
+    }
+    w.hijacker = nil
+    w.pending, w.pendingStatus, w.pendingBody = false, 0, nil
+    w.state = writerStateDone
+    return conn, rw, nil
+}
@@ -0,0 +1,311 @@
+package router
+
+import (
+    "fmt"
+    "net/url"
+    "sort"
+    "strings"
+
+    "github.com/mrtuuro/http-from-tcp/internal/headers"
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+    "github.com/mrtuuro/http-from-tcp/internal/response"
+    "github.com/mrtuuro/http-from-tcp/internal/server"
+)
+
+// Router dispatches requests to handlers by method and path. Patterns are
+// made of "/" separated segments, each one either static, a "{name}"
+// parameter matching a single segment, or, as the last segment only, a
+// "{name...}" wildcard matching the rest of the path. Static segments win
+// over parameters and parameters win over wildcards.
+//
+// Requests for a known path with an unregistered method get a 405 with an
+// Allow header, HEAD falls back to the GET handler and OPTIONS is answered
+// automatically unless handlers are registered for them.
+type Router struct {
+    routes
+
+    // NotFound replaces the default 404 response when set
+    NotFound server.Handler
+
+    root *node
+}
+
+// Group registers routes under a shared path prefix
+type Group struct {
+    routes
+}
+
+// routes holds the registration methods shared by Router and Group
+type routes struct {
+    router *Router
+    prefix string
+}
+
+func New() *Router {
+    r := &Router{root: &node{}}
+    r.routes = routes{router: r}
+    return r
+}
+
+// Group returns a group whose routes are all prefixed with prefix
+func (g *routes) Group(prefix string) *Group {
+    return &Group{routes{
+        router: g.router,
+        prefix: g.prefix + strings.TrimSuffix(prefix, "/"),
+    }}
+}
+
+// Handle registers h for method and pattern. It panics if the pattern is
+// malformed or already registered for method, like a duplicate case in
+// a switch.
+func (g *routes) Handle(method, pattern string, h server.Handler) {
+    g.router.handle(method, g.prefix+pattern, h)
+}
+
+func (g *routes) Get(pattern string, h server.Handler) {
+    g.Handle("GET", pattern, h)
+}
+
+func (g *routes) Head(pattern string, h server.Handler) {
+    g.Handle("HEAD", pattern, h)
+}
+
+func (g *routes) Post(pattern string, h server.Handler) {
+    g.Handle("POST", pattern, h)
+}
+
+func (g *routes) Put(pattern string, h server.Handler) {
+    g.Handle("PUT", pattern, h)
+}
+
+func (g *routes) Patch(pattern string, h server.Handler) {
+    g.Handle("PATCH", pattern, h)
+}
+
+func (g *routes) Delete(pattern string, h server.Handler) {
+    g.Handle("DELETE", pattern, h)
+}
+
+func (g *routes) Options(pattern string, h server.Handler) {
+    g.Handle("OPTIONS", pattern, h)
+}
+
+func (r *Router) handle(method, pattern string, h server.Handler) {
+    if method == "" || h == nil {
+        panic(fmt.Sprintf("router: missing method or handler for %q", pattern))
+    }
+    segments, err := splitPattern(pattern)
+    if err != nil {
+        panic(err)
+    }
+    n := r.root
+    for _, seg := range segments {
+        n = n.child(seg)
+    }
+    if n.pattern != "" && n.pattern != pattern {
+        panic(fmt.Sprintf("router: pattern %q conflicts with %q", pattern, n.pattern))
+    }
+    if _, found := n.handlers[method]; found {
+        panic(fmt.Sprintf("router: %s %s registered twice", method, pattern))
+    }
+    if n.handlers == nil {
+        n.handlers = make(map[string]server.Handler)
+    }
+    n.pattern = pattern
+    n.handlers[method] = h
+}
+
+// Serve is a server.Handler dispatching req to the matching route
+func (r *Router) Serve(w *response.Writer, req *request.Request) {
+    path := req.RequestLine.RequestTarget
+    if i := strings.IndexByte(path, '?'); i != -1 {
+        path = path[:i]
+    }
+    if !strings.HasPrefix(path, "/") {
+        r.notFound(w, req)
+        return
+    }
+
+    params := map[string]string{}
+    n := r.root.match(strings.Split(path[1:], "/"), params)
+    if n == nil {
+        r.notFound(w, req)
+        return
+    }
+    for name, value := range params {
+        req.SetPathValue(name, value)
+    }
+
+    method := req.RequestLine.Method
+    if h, found := n.handlers[method]; found {
+        h(w, req)
+        return
+    }
+    if h, found := n.handlers["GET"]; found && method == "HEAD" {
+        h(w, req)
+        return
+    }
+    if method == "OPTIONS" {
+        w.WriteStatusLine(response.StatusNoContent)
+        h := headers.NewHeaders()
+        h.Set("Allow", n.allow())
+        // NOTE: a 204 has no body and must not carry Content-Length
+        // (RFC 9110 8.6)
+        w.WriteHeaders(h)
+        return
+    }
+    h := headers.NewHeaders()
+    h.Set("Allow", n.allow())
+    response.WriteStatus(w, response.StatusMethodNotAllowed, h)
+}
+
+func (r *Router) notFound(w *response.Writer, req *request.Request) {
+    if r.NotFound != nil {
+        r.NotFound(w, req)
+        return
+    }
+    response.WriteStatus(w, response.StatusNotFound, nil)
+}
+
+// splitPattern checks pattern and splits it into segments
+func splitPattern(pattern string) ([]string, error) {
+    if !strings.HasPrefix(pattern, "/") {
+        return nil, fmt.Errorf("router: pattern %q must start with /", pattern)
+    }
+    segments := strings.Split(pattern[1:], "/")
+    seen := map[string]bool{}
+    for i, seg := range segments {
+        if !strings.ContainsAny(seg, "{}") {
+            continue
+        }
+        name, wildcard, ok := parseParam(seg)
+        if !ok {
+            return nil, fmt.Errorf("router: bad segment %q in pattern %q", seg, pattern)
+        }
+        if wildcard && i != len(segments)-1 {
+            return nil, fmt.Errorf("router: wildcard %q must be the last segment of %q", seg, pattern)
+        }
+        if seen[name] {
+            return nil, fmt.Errorf("router: duplicate parameter %q in pattern %q", name, pattern)
+        }
+        seen[name] = true
+    }
+    return segments, nil
+}
+
+// parseParam parses a "{name}" or "{name...}" segment
+func parseParam(seg string) (name string, wildcard bool, ok bool) {
+    if len(seg) < 3 || seg[0] != '{' || seg[len(seg)-1] != '}' {
+        return "", false, false
+    }
+    name = seg[1 : len(seg)-1]
+    name, wildcard = strings.CutSuffix(name, "...")
+    if name == "" || strings.ContainsAny(name, "{}") {
+        return "", false, false
+    }
+    return name, wildcard, true
+}
+
+// node is a segment of the route trie
+type node struct {
+    static map[string]*node
+
+    param     *node
+    paramName string
+
+    wildcard     *node
+    wildcardName string
+
+    // NOTE: set on nodes ending a registered pattern
+    pattern  string
+    handlers map[string]server.Handler
+}
+
+// child returns the child for the pattern segment seg, creating it if needed
+func (n *node) child(seg string) *node {
+    name, wildcard, ok := parseParam(seg)
+    switch {
+    case !ok:
+        if n.static == nil {
+            n.static = make(map[string]*node)
+        }
+        if n.static[seg] == nil {
+            n.static[seg] = &node{}
+        }
+        return n.static[seg]
+    case wildcard:
+        if n.wildcard == nil {
+            n.wildcard = &node{}
+            n.wildcardName = name
+        }
+        if n.wildcardName != name {
+            panic(fmt.Sprintf("router: wildcard {%s...} conflicts with {%s...}", name, n.wildcardName))
+        }
+        return n.wildcard
+    default:
+        if n.param == nil {
+            n.param = &node{}
+            n.paramName = name
+        }
+        if n.paramName != name {
+            panic(fmt.Sprintf("router: parameter {%s} conflicts with {%s}", name, n.paramName))
+        }
+        return n.param
+    }
+}
+
+// match finds the route for the remaining path segments, trying static
+// children first, then parameters and wildcards last. Captured values are
+// stored in params.
+func (n *node) match(segments []string, params map[string]string) *node {
+    if len(segments) == 0 {
+        if n.handlers != nil {
+            return n
+        }
+        return nil
+    }
+
+    seg := segments[0]
+    if child := n.static[seg]; child != nil {
+        if found := child.match(segments[1:], params); found != nil {
+            return found
+        }
+    }
+    if n.param != nil && seg != "" {
+        if found := n.param.match(segments[1:], params); found != nil {
+            params[n.paramName] = unescape(seg)
+            return found
+        }
+    }
+    if n.wildcard != nil && n.wildcard.handlers != nil {
+        params[n.wildcardName] = unescape(strings.Join(segments, "/"))
+        return n.wildcard
+    }
+    return nil
+}
+
+// allow lists the methods the node answers to, for the Allow header
+func (n *node) allow() string {
+    methods := []string{"OPTIONS"}
+    for method := range n.handlers {
+        if method != "OPTIONS" {
+            methods = append(methods, method)
+        }
+    }
+    if _, found := n.handlers["GET"]; found {
+        if _, found := n.handlers["HEAD"]; !found {
+            methods = append(methods, "HEAD")
+        }
+    }
+    sort.Strings(methods)
+    return strings.Join(methods, ", ")
+}
+
+// unescape decodes percent-encoded path parameters, keeping the raw value
+// if it is malformed
+func unescape(s string) string {
+    if v, err := url.PathUnescape(s); err == nil {
+        return v
+    }
+    return s
+}
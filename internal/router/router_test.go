@@ -0,0 +1,153 @@
+package router
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+    "github.com/mrtuuro/http-from-tcp/internal/response"
+    "github.com/mrtuuro/http-from-tcp/internal/servertest"
+)
+
+// text responds with msg followed by the given path values
+func text(msg string, names ...string) func(w *response.Writer, req *request.Request) {
+    return func(w *response.Writer, req *request.Request) {
+        out := msg
+        for _, name := range names {
+            out += " " + name + "=" + req.PathValue(name)
+        }
+        body := []byte(out)
+        w.WriteStatusLine(response.StatusOK)
+        w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+        w.WriteBody(body)
+    }
+}
+
+func TestRouterMatching(t *testing.T) {
+    r := New()
+    r.Get("/", text("root"))
+    r.Get("/users", text("list"))
+    r.Get("/users/me", text("me"))
+    r.Get("/users/{id}", text("user", "id"))
+    r.Get("/users/{id}/posts/{post}", text("post", "id", "post"))
+    r.Get("/static/{path...}", text("static", "path"))
+
+    // TEST: Root path
+    out := servertest.Serve(t, r.Serve, "GET", "/")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\nroot"), out)
+
+    // TEST: Static segment wins over a parameter
+    out = servertest.Serve(t, r.Serve, "GET", "/users/me")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\nme"), out)
+
+    // TEST: Parameter captures a single segment
+    out = servertest.Serve(t, r.Serve, "GET", "/users/42")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\nuser id=42"), out)
+
+    // TEST: Several parameters, query string ignored
+    out = servertest.Serve(t, r.Serve, "GET", "/users/42/posts/7?page=2")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\npost id=42 post=7"), out)
+
+    // TEST: Parameters are percent-decoded
+    out = servertest.Serve(t, r.Serve, "GET", "/users/jane%20doe")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\nuser id=jane doe"), out)
+
+    // TEST: Wildcard captures the rest of the path
+    out = servertest.Serve(t, r.Serve, "GET", "/static/css/site.css")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\nstatic path=css/site.css"), out)
+
+    // TEST: Wildcard matches an empty remainder
+    out = servertest.Serve(t, r.Serve, "GET", "/static/")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\nstatic path="), out)
+
+    // TEST: Unknown path is a 404
+    out = servertest.Serve(t, r.Serve, "GET", "/nope")
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"), out)
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\n404 Not Found"), out)
+
+    // TEST: Parameters don't match empty segments
+    out = servertest.Serve(t, r.Serve, "GET", "/users/42/posts/")
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"), out)
+
+    // TEST: Custom not found handler
+    r.NotFound = text("custom")
+    out = servertest.Serve(t, r.Serve, "GET", "/nope")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\ncustom"), out)
+}
+
+func TestRouterMethods(t *testing.T) {
+    r := New()
+    r.Get("/items", text("list"))
+    r.Post("/items", text("create"))
+    r.Delete("/items/{id}", text("delete", "id"))
+
+    // TEST: Per-method handlers
+    out := servertest.Serve(t, r.Serve, "POST", "/items")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\ncreate"), out)
+
+    // TEST: Unregistered method is a 405 listing the allowed ones
+    out = servertest.Serve(t, r.Serve, "PUT", "/items")
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"), out)
+    assert.Contains(t, out, "\r\nAllow: GET, HEAD, OPTIONS, POST\r\n")
+
+    // TEST: HEAD falls back to GET without a body
+    out = servertest.Serve(t, r.Serve, "HEAD", "/items")
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"), out)
+    assert.Contains(t, out, "Content-Length: 4\r\n")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\n"), out)
+
+    // TEST: HEAD is not allowed without GET
+    out = servertest.Serve(t, r.Serve, "HEAD", "/items/1")
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"), out)
+    assert.Contains(t, out, "\r\nAllow: DELETE, OPTIONS\r\n")
+
+    // TEST: Automatic OPTIONS
+    out = servertest.Serve(t, r.Serve, "OPTIONS", "/items")
+    assert.Equal(t, "HTTP/1.1 204 No Content\r\n"+
+        "Allow: GET, HEAD, OPTIONS, POST\r\n"+
+        "\r\n", out)
+
+    // TEST: Registered OPTIONS handler wins
+    r.Options("/items", text("options"))
+    out = servertest.Serve(t, r.Serve, "OPTIONS", "/items")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\noptions"), out)
+}
+
+func TestRouterGroups(t *testing.T) {
+    r := New()
+    api := r.Group("/api")
+    v1 := api.Group("/v1/")
+    v1.Get("/users/{id}", text("v1", "id"))
+    api.Get("/health", text("ok"))
+
+    // TEST: Nested group prefixes
+    out := servertest.Serve(t, r.Serve, "GET", "/api/v1/users/9")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\nv1 id=9"), out)
+
+    out = servertest.Serve(t, r.Serve, "GET", "/api/health")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\nok"), out)
+
+    // TEST: Group prefix alone is not a route
+    out = servertest.Serve(t, r.Serve, "GET", "/api")
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"), out)
+}
+
+func TestRouterRegistration(t *testing.T) {
+    // TEST: Duplicate route
+    r := New()
+    r.Get("/a/{id}", text("a"))
+    assert.Panics(t, func() { r.Get("/a/{id}", text("b")) })
+
+    // TEST: Conflicting parameter names at the same position
+    assert.Panics(t, func() { r.Get("/a/{name}/x", text("b")) })
+
+    // TEST: Wildcard that is not the last segment
+    assert.Panics(t, func() { r.Get("/b/{rest...}/x", text("b")) })
+
+    // TEST: Malformed patterns
+    assert.Panics(t, func() { r.Get("no-slash", text("b")) })
+    assert.Panics(t, func() { r.Get("/c/{}", text("b")) })
+    assert.Panics(t, func() { r.Get("/c/{id}/{id}", text("b")) })
+}
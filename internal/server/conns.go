@@ -0,0 +1,162 @@
+package server
+
+import (
+    "io"
+    "net"
+    "strconv"
+    "time"
+
+    "github.com/mrtuuro/http-from-tcp/internal/response"
+)
+
+type connState int
+
+const (
+    // NOTE: a connection is new from the moment it is accepted until the
+    // first byte of a request arrives, active from then until its response
+    // is done, and idle while waiting for the next request
+    connStateNew connState = iota
+    connStateActive
+    connStateIdle
+)
+
+// shutdownPollInterval is how often Shutdown checks for connections that
+// went idle
+const shutdownPollInterval = 50 * time.Millisecond
+
+type admission int
+
+const (
+    connAdmitted admission = iota
+    connOverLimit
+    connServerClosed
+)
+
+// waitForConnSlot blocks while MaxConns connections are open, leaving new
+// clients in the listen backlog. It returns false once the server stops.
+func (s *Server) waitForConnSlot() bool {
+    if s.connSlots == nil {
+        return true
+    }
+    select {
+    case s.connSlots <- struct{}{}:
+        return true
+    case <-s.ctx.Done():
+        return false
+    }
+}
+
+func (s *Server) releaseConnSlot() {
+    if s.connSlots != nil {
+        <-s.connSlots
+    }
+}
+
+// trackConn registers a newly accepted connection, unless the server is
+// closed or the connection is over one of the limits
+func (s *Server) trackConn(conn net.Conn) admission {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed.Load() {
+        return connServerClosed
+    }
+    // NOTE: in back-pressure mode MaxConns is enforced by connSlots
+    if s.connSlots == nil && s.opts.MaxConns > 0 && len(s.conns) >= s.opts.MaxConns {
+        return connOverLimit
+    }
+    ip := clientIP(conn)
+    if ip != "" && s.opts.MaxConnsPerIP > 0 {
+        if s.connsPerIP[ip] >= s.opts.MaxConnsPerIP {
+            return connOverLimit
+        }
+        if s.connsPerIP == nil {
+            s.connsPerIP = make(map[string]int)
+        }
+        s.connsPerIP[ip]++
+    }
+    if s.conns == nil {
+        s.conns = make(map[net.Conn]connState)
+    }
+    s.conns[conn] = connStateNew
+    return connAdmitted
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, found := s.conns[conn]; !found {
+        return
+    }
+    delete(s.conns, conn)
+    if ip := clientIP(conn); ip != "" && s.opts.MaxConnsPerIP > 0 {
+        if s.connsPerIP[ip]--; s.connsPerIP[ip] <= 0 {
+            delete(s.connsPerIP, ip)
+        }
+    }
+    s.releaseConnSlot()
+}
+
+// setConnState records conn's state. It returns false when conn is about
+// to go idle on a closed server and should be closed instead.
+func (s *Server) setConnState(conn net.Conn, state connState) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if state == connStateIdle && s.closed.Load() {
+        return false
+    }
+    if _, found := s.conns[conn]; found {
+        s.conns[conn] = state
+    }
+    return true
+}
+
+// closeConns closes idle connections and new ones that haven't sent
+// anything yet, or all of them when force is set, and returns how many are
+// still active
+func (s *Server) closeConns(force bool) int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    active := 0
+    for conn, state := range s.conns {
+        if force || state == connStateIdle || state == connStateNew {
+            conn.Close()
+            continue
+        }
+        active++
+    }
+    return active
+}
+
+// rejectConn answers a connection over the limits with a 503 and closes it
+func (s *Server) rejectConn(conn net.Conn) {
+    defer s.releaseConnSlot()
+    defer conn.Close()
+
+    retryAfter := s.opts.RetryAfter
+    if retryAfter <= 0 {
+        retryAfter = time.Second
+    }
+    seconds := int((retryAfter + time.Second - 1) / time.Second)
+
+    conn.SetDeadline(time.Now().Add(time.Second))
+    w := response.NewWriter(conn)
+    w.Header().Set("Retry-After", strconv.Itoa(seconds))
+    writeErrorResponse(w, response.StatusServiceUnavailable, "Service Unavailable")
+
+    // NOTE: closing with the request still unread makes the kernel reset
+    // the connection, which can throw away the 503 before the client reads
+    // it. Half close and drain a little first.
+    if tcpConn, ok := conn.(*net.TCPConn); ok {
+        tcpConn.CloseWrite()
+    }
+    io.Copy(io.Discard, io.LimitReader(conn, 64<<10))
+}
+
+// clientIP returns the IP address of a TCP client, or "" for other
+// kinds of connections
+func clientIP(conn net.Conn) string {
+    if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+        return addr.IP.String()
+    }
+    return ""
+}
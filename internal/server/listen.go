@@ -0,0 +1,129 @@
+package server
+
+import (
+    "fmt"
+    "io/fs"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// defaultUnixSocketMode keeps Unix sockets to the server's own user
+// unless asked otherwise
+const defaultUnixSocketMode os.FileMode = 0o600
+
+// Listen opens a listener for addr, which is one of
+//
+//    host:port         TCP, e.g. ":8080", "127.0.0.1:8080" or "[::1]:8080"
+//    unix:/path        Unix domain socket with mode 0o600, see ListenUnix
+//    systemd:          first socket passed in by systemd socket activation
+//    systemd:N         N-th socket passed in by systemd, counting from 0
+func Listen(addr string) (net.Listener, error) {
+    return listen(addr, defaultUnixSocketMode)
+}
+
+func listen(addr string, mode os.FileMode) (net.Listener, error) {
+    switch {
+    case strings.HasPrefix(addr, "unix:"):
+        return ListenUnix(strings.TrimPrefix(addr, "unix:"), mode)
+    case strings.HasPrefix(addr, "systemd:"):
+        index := 0
+        if n := strings.TrimPrefix(addr, "systemd:"); n != "" {
+            var err error
+            index, err = strconv.Atoi(n)
+            if err != nil || index < 0 {
+                return nil, fmt.Errorf("invalid systemd socket index: %q", n)
+            }
+        }
+        listeners, err := SystemdListeners()
+        if err != nil {
+            return nil, err
+        }
+        if index >= len(listeners) {
+            return nil, fmt.Errorf("systemd passed %d sockets, wanted #%d", len(listeners), index)
+        }
+        for i, l := range listeners {
+            if i != index {
+                l.Close()
+            }
+        }
+        return listeners[index], nil
+    default:
+        return net.Listen("tcp", addr)
+    }
+}
+
+// ListenUnix listens on a Unix domain socket at path and sets its
+// permissions to mode, so access can be limited to e.g. a reverse proxy's
+// group. A socket left behind at path by a previous run is replaced; the
+// socket file is removed again when the listener is closed.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+    if info, err := os.Lstat(path); err == nil {
+        if info.Mode().Type() != fs.ModeSocket {
+            return nil, fmt.Errorf("%s exists and is not a socket", path)
+        }
+        if err := os.Remove(path); err != nil {
+            return nil, err
+        }
+    }
+    l, err := net.Listen("unix", path)
+    if err != nil {
+        return nil, err
+    }
+    if err := os.Chmod(path, mode); err != nil {
+        l.Close()
+        return nil, err
+    }
+    return l, nil
+}
+
+// listenFDsStart is the first file descriptor passed by systemd
+const listenFDsStart = 3
+
+// SystemdListeners returns the sockets passed in by systemd socket
+// activation (LISTEN_PID and LISTEN_FDS), in order. It returns no
+// listeners and no error when the process was not socket activated.
+// The environment variables are cleared so child processes don't
+// inherit them.
+func SystemdListeners() ([]net.Listener, error) {
+    pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+    if err != nil || pid != os.Getpid() {
+        return nil, nil
+    }
+    n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+    if err != nil || n < 0 {
+        return nil, fmt.Errorf("invalid LISTEN_FDS: %q", os.Getenv("LISTEN_FDS"))
+    }
+    os.Unsetenv("LISTEN_PID")
+    os.Unsetenv("LISTEN_FDS")
+    os.Unsetenv("LISTEN_FDNAMES")
+    return listenersFromFDs(listenFDsStart, n)
+}
+
+// listenersFromFDs turns n inherited file descriptors starting at start
+// into listeners
+func listenersFromFDs(start, n int) ([]net.Listener, error) {
+    listeners := make([]net.Listener, 0, n)
+    for fd := start; fd < start+n; fd++ {
+        f := os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd))
+        if f == nil {
+            return closeAll(listeners, fmt.Errorf("invalid file descriptor %d", fd))
+        }
+        // NOTE: FileListener dups the descriptor, the original is closed
+        l, err := net.FileListener(f)
+        f.Close()
+        if err != nil {
+            return closeAll(listeners, fmt.Errorf("file descriptor %d: %w", fd, err))
+        }
+        listeners = append(listeners, l)
+    }
+    return listeners, nil
+}
+
+func closeAll(listeners []net.Listener, err error) ([]net.Listener, error) {
+    for _, l := range listeners {
+        l.Close()
+    }
+    return nil, err
+}
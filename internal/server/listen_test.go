@@ -0,0 +1,119 @@
+package server
+
+import (
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+    "github.com/mrtuuro/http-from-tcp/internal/response"
+)
+
+func okHandler(w *response.Writer, _ *request.Request) {
+    w.WriteStatusLine(response.StatusOK)
+    h := response.GetDefaultHeaders(2)
+    h.Set("Connection", "close")
+    w.WriteHeaders(h)
+    w.WriteBody([]byte("ok"))
+}
+
+// get sends a GET over a fresh connection to addr and reads until close
+func get(t *testing.T, network, addr string) string {
+    t.Helper()
+    conn, err := net.Dial(network, addr)
+    require.NoError(t, err)
+    defer conn.Close()
+    conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+    out, err := io.ReadAll(conn)
+    require.NoError(t, err)
+    return string(out)
+}
+
+func TestListen(t *testing.T) {
+    // TEST: Specific interface
+    s, err := ServeAddr("127.0.0.1:0", okHandler, Options{})
+    require.NoError(t, err)
+    assert.Contains(t, get(t, "tcp", s.listener.Addr().String()), "\r\n\r\nok")
+    s.Close()
+
+    // TEST: IPv6 literal
+    if l, err := Listen("[::1]:0"); err == nil {
+        s = ServeListener(l, okHandler, Options{})
+        assert.Contains(t, get(t, "tcp", l.Addr().String()), "\r\n\r\nok")
+        s.Close()
+    }
+
+    // TEST: Unix socket with permissions
+    path := filepath.Join(t.TempDir(), "http.sock")
+    s, err = ServeAddr("unix:"+path, okHandler, Options{})
+    require.NoError(t, err)
+    info, err := os.Stat(path)
+    require.NoError(t, err)
+    assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+    assert.Contains(t, get(t, "unix", path), "\r\n\r\nok")
+    s.Close()
+    _, err = os.Stat(path)
+    assert.True(t, os.IsNotExist(err))
+
+    s, err = ServeAddr("unix:"+path, okHandler, Options{UnixSocketMode: 0o660})
+    require.NoError(t, err)
+    info, err = os.Stat(path)
+    require.NoError(t, err)
+    assert.Equal(t, os.FileMode(0o660), info.Mode().Perm())
+    s.Close()
+
+    l, err := Listen("unix:" + path)
+    require.NoError(t, err)
+    info, err = os.Stat(path)
+    require.NoError(t, err)
+    assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+    l.Close()
+
+    l, err = ListenUnix(path, 0o660)
+    require.NoError(t, err)
+    info, err = os.Stat(path)
+    require.NoError(t, err)
+    assert.Equal(t, os.FileMode(0o660), info.Mode().Perm())
+
+    // TEST: Stale socket is replaced, regular files are not
+    l.(*net.UnixListener).SetUnlinkOnClose(false)
+    l.Close()
+    l, err = ListenUnix(path, 0o600)
+    require.NoError(t, err)
+    l.Close()
+    file := filepath.Join(t.TempDir(), "file")
+    require.NoError(t, os.WriteFile(file, nil, 0o600))
+    _, err = ListenUnix(file, 0o600)
+    assert.Error(t, err)
+
+    // TEST: Bad addresses
+    _, err = Listen("nope")
+    assert.Error(t, err)
+    _, err = Listen("systemd:x")
+    assert.Error(t, err)
+}
+
+func TestSystemdListeners(t *testing.T) {
+    // TEST: Not socket activated
+    t.Setenv("LISTEN_PID", "1")
+    t.Setenv("LISTEN_FDS", "1")
+    listeners, err := SystemdListeners()
+    require.NoError(t, err)
+    assert.Empty(t, listeners)
+    _, err = Listen("systemd:")
+    assert.Error(t, err)
+
+    // TEST: Environment meant for this process is consumed
+    t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+    t.Setenv("LISTEN_FDS", "0")
+    listeners, err = SystemdListeners()
+    require.NoError(t, err)
+    assert.Empty(t, listeners)
+    assert.Empty(t, os.Getenv("LISTEN_PID"))
+}
@@ -0,0 +1,39 @@
+//go:build unix
+
+package server
+
+import (
+    "net"
+    "syscall"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+func TestListenersFromFDs(t *testing.T) {
+    // TEST: Inherited descriptors become listeners
+    tcp, err := net.Listen("tcp", "127.0.0.1:0")
+    require.NoError(t, err)
+    addr := tcp.Addr().String()
+    f, err := tcp.(*net.TCPListener).File()
+    require.NoError(t, err)
+    fd, err := syscall.Dup(int(f.Fd()))
+    require.NoError(t, err)
+    f.Close()
+    tcp.Close()
+
+    listeners, err := listenersFromFDs(fd, 1)
+    require.NoError(t, err)
+    require.Len(t, listeners, 1)
+    s := ServeListener(listeners[0], okHandler, Options{})
+    defer s.Close()
+    assert.Contains(t, get(t, "tcp", addr), "\r\n\r\nok")
+
+    // TEST: Descriptors that are not sockets
+    var pipe [2]int
+    require.NoError(t, syscall.Pipe(pipe[:]))
+    defer syscall.Close(pipe[1])
+    _, err = listenersFromFDs(pipe[0], 1)
+    assert.Error(t, err)
+}
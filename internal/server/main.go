@@ -1,10 +1,21 @@
 package server
 
 import (
+    "bufio"
+    "bytes"
+    "context"
+    "crypto/tls"
+    "errors"
     "fmt"
+    "io"
     "log"
     "net"
+    "os"
+    "runtime/debug"
+    "strings"
+    "sync"
     "sync/atomic"
+    "time"
 
     "github.com/mrtuuro/http-from-tcp/internal/request"
     "github.com/mrtuuro/http-from-tcp/internal/response"
@@ -12,64 +23,458 @@ import (
 
 type Handler func(w *response.Writer, req *request.Request)
 
+// Options tunes connection handling. The zero value means no limits.
+type Options struct {
+    // ReadHeaderTimeout is how long a client has to send the request-line
+    // and headers once the request has started. When it fires the client
+    // gets a 408 Request Timeout. Falls back to ReadTimeout when zero.
+    ReadHeaderTimeout time.Duration
+    // ReadTimeout bounds reading the whole request, body included
+    ReadTimeout time.Duration
+    // WriteTimeout bounds writing the response, counted from the end of
+    // the request headers. Request contexts expire at the same time.
+    WriteTimeout time.Duration
+    // IdleTimeout is how long a keep-alive connection may sit idle waiting
+    // for the next request before it is closed. Falls back to ReadTimeout
+    // when zero.
+    IdleTimeout time.Duration
+    // MaxRequestsPerConn is the number of requests served on a single
+    // connection before it is closed
+    MaxRequestsPerConn int
+    // Limits caps request sizes, nil means request.DefaultLimits
+    Limits *request.Limits
+    // OnPanic is called with the recovered value and stack trace when a
+    // handler panics, after the panic has been logged
+    OnPanic func(req *request.Request, recovered any, stack []byte)
+
+    // MaxConns caps the number of open connections. Once reached the
+    // server stops accepting and new clients wait in the listen backlog,
+    // or get a 503 Service Unavailable right away when RetryAfter is set.
+    MaxConns int
+    // MaxConnsPerIP caps the open connections per client IP address.
+    // Clients over it get a 503 Service Unavailable.
+    MaxConnsPerIP int
+    // RetryAfter is announced in the Retry-After header of the 503s sent
+    // to connections over the limits, rounded up to whole seconds
+    RetryAfter time.Duration
+    // Workers runs handlers on a fixed pool of that many goroutines, so
+    // no more than Workers requests are handled at once. Requests wait
+    // for a free worker. Zero runs every handler on its connection's
+    // goroutine.
+    Workers int
+
+    // UnixSocketMode is the permissions ServeAddr gives a Unix domain
+    // socket, zero means 0o600: only the server's own user can connect
+    UnixSocketMode os.FileMode
+}
+
 type Server struct {
     handler  Handler
+    opts     Options
     listener net.Listener
     closed   atomic.Bool
+
+    mu         sync.Mutex
+    conns      map[net.Conn]connState
+    connsPerIP map[string]int
+    connSlots  chan struct{}
+    jobs       chan func()
+
+    // NOTE: parent of every request context, cancelled when the server
+    // stops for good
+    ctx    context.Context
+    cancel context.CancelFunc
 }
 
 func NewServer(h Handler) *Server {
-    return &Server{
+    return NewServerWithOptions(h, Options{})
+}
+
+func NewServerWithOptions(h Handler, opts Options) *Server {
+    ctx, cancel := context.WithCancel(context.Background())
+    s := &Server{
         handler: h,
+        opts:    opts,
+        ctx:     ctx,
+        cancel:  cancel,
+    }
+    if opts.MaxConns > 0 && opts.RetryAfter <= 0 {
+        s.connSlots = make(chan struct{}, opts.MaxConns)
+    }
+    if opts.Workers > 0 {
+        s.jobs = make(chan func())
+        for range opts.Workers {
+            go s.worker()
+        }
     }
+    return s
 }
 
 func Serve(port int, handler Handler) (*Server, error) {
-    s := NewServer(handler)
+    return ServeWithOptions(port, handler, Options{})
+}
+
+func ServeWithOptions(port int, handler Handler, opts Options) (*Server, error) {
     l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
     if err != nil {
         return nil, err
     }
+    return ServeListener(l, handler, opts), nil
+}
+
+// ServeAddr listens on addr, in any of the forms accepted by Listen, and
+// serves connections in the background. Unix sockets get the permissions
+// in opts.UnixSocketMode.
+func ServeAddr(addr string, handler Handler, opts Options) (*Server, error) {
+    mode := opts.UnixSocketMode
+    if mode == 0 {
+        mode = defaultUnixSocketMode
+    }
+    l, err := listen(addr, mode)
+    if err != nil {
+        return nil, err
+    }
+    return ServeListener(l, handler, opts), nil
+}
 
+// ServeListener serves connections accepted from l in the background. The
+// server owns l from then on and closes it on Close or Shutdown. Wrap l
+// with tls.NewListener to serve HTTPS.
+func ServeListener(l net.Listener, handler Handler, opts Options) *Server {
+    s := NewServerWithOptions(handler, opts)
     s.listener = l
     go s.listen()
-    return s, nil
+    return s
 }
 
 func (s *Server) listen() {
     for {
+        if !s.waitForConnSlot() {
+            return
+        }
         conn, err := s.listener.Accept()
         if err != nil {
+            s.releaseConnSlot()
             if s.closed.Load() {
                 return
             }
             log.Printf("Error accepting connection: %v", err)
             continue
         }
-        go s.handle(conn)
+        switch s.trackConn(conn) {
+        case connAdmitted:
+            go s.handle(conn)
+        case connOverLimit:
+            go s.rejectConn(conn)
+        default:
+            s.releaseConnSlot()
+            conn.Close()
+            return
+        }
     }
 }
 
+// handle serves requests off conn until either side asks to close, the
+// connection goes idle for too long or a response can't be delimited
 func (s *Server) handle(conn net.Conn) {
-    defer conn.Close()
+    defer s.untrackConn(conn)
+    hijacked := false
+    defer func() {
+        if !hijacked {
+            conn.Close()
+        }
+    }()
 
-    w := response.NewWriter(conn)
-    req, err := request.RequestFromReader(conn)
-    if err != nil {
-        w.WriteStatusLine(response.StatusBadRequest)
-        body := []byte(fmt.Sprintf("Error parsing request: %v", err))
-        w.WriteHeaders(response.GetDefaultHeaders(len(body)))
-        w.WriteBody(body)
-        return
+    ctx, cancel := context.WithCancel(s.ctx)
+    defer cancel()
+    cr := newConnReader(conn, cancel)
+
+    limits := request.DefaultLimits
+    if s.opts.Limits != nil {
+        limits = *s.opts.Limits
+    }
+    reader := request.NewReaderWithLimits(cr, limits)
+
+    var tlsState *tls.ConnectionState
+    if tlsConn, ok := conn.(*tls.Conn); ok {
+        s.setReadDeadline(conn, time.Now(), s.headerTimeout())
+        s.setWriteDeadline(conn)
+        if err := tlsConn.HandshakeContext(ctx); err != nil {
+            log.Printf("TLS handshake error from %s: %v", conn.RemoteAddr(), err)
+            return
+        }
+        state := tlsConn.ConnectionState()
+        tlsState = &state
+    }
+
+    for served := 0; ; served++ {
+        start := time.Now()
+        if served > 0 {
+            if !s.setConnState(conn, connStateIdle) {
+                return
+            }
+            if err := s.waitForRequest(conn, reader); err != nil {
+                return
+            }
+            s.setConnState(conn, connStateActive)
+            start = time.Now()
+        } else {
+            // NOTE: the header timeout runs from the accept, a failed wait
+            // shows up again from ReadRequest below
+            s.setReadDeadline(conn, start, s.headerTimeout())
+            if reader.WaitForRequest() == nil {
+                s.setConnState(conn, connStateActive)
+            }
+        }
+
+        s.setReadDeadline(conn, start, s.headerTimeout())
+        req, err := reader.ReadRequest()
+        if err != nil {
+            if isTimeout(err) {
+                s.setWriteDeadline(conn)
+                writeError(conn, response.StatusRequestTimeout, "Request timed out")
+                return
+            }
+            if isConnError(err) {
+                return
+            }
+            s.setWriteDeadline(conn)
+            statusCode, message := parseErrorResponse(err)
+            writeError(conn, statusCode, message)
+            return
+        }
+        s.setReadDeadline(conn, start, s.opts.ReadTimeout)
+        s.setWriteDeadline(conn)
+
+        req.TLS = tlsState
+        req.RemoteAddr = conn.RemoteAddr().String()
+        reqCtx, cancelReq := s.requestContext(ctx)
+        req = req.WithContext(reqCtx)
+        if req.Body == request.NoBody {
+            cr.startBackgroundRead()
+        } else {
+            req.Body = &eofBody{ReadCloser: req.Body, cr: cr}
+        }
+
+        w := response.NewWriter(conn)
+        w.SetKeepAlive(s.keepAlive(req, served+1))
+        w.SetDiscardBody(req.RequestLine.Method == "HEAD")
+        w.SetHijacker(func() (net.Conn, *bufio.ReadWriter, error) {
+            cr.abortPendingRead()
+            conn.SetDeadline(time.Time{})
+            // NOTE: a hijacked connection no longer counts against the
+            // limits and is left alone by Shutdown
+            s.untrackConn(conn)
+            hijacked = true
+            br := bufio.NewReader(io.MultiReader(bytes.NewReader(reader.Buffered()), cr))
+            return conn, bufio.NewReadWriter(br, bufio.NewWriter(conn)), nil
+        })
+        ok := s.serveRequest(w, req)
+        cr.abortPendingRead()
+        cancelReq()
+        if hijacked {
+            return
+        }
+        // NOTE: Close ends chunked bodies the handler left open, and fails
+        // for incomplete ones, which can't be followed by another response
+        if !ok || w.Close() != nil || !w.KeepAlive() {
+            return
+        }
+        // NOTE: skip whatever the handler left unread so the next
+        // pipelined request starts at the right byte
+        if err := req.Body.Close(); err != nil {
+            return
+        }
+    }
+}
+
+// serveRequest runs the handler, on a worker from the pool if there is one
+func (s *Server) serveRequest(w *response.Writer, req *request.Request) bool {
+    if s.jobs == nil {
+        return s.runHandler(w, req)
+    }
+    done := make(chan bool, 1)
+    select {
+    case s.jobs <- func() { done <- s.runHandler(w, req) }:
+        return <-done
+    case <-req.Context().Done():
+        return false
+    }
+}
+
+func (s *Server) worker() {
+    for {
+        select {
+        case job := <-s.jobs:
+            job()
+        case <-s.ctx.Done():
+            return
+        }
+    }
+}
+
+// requestContext derives the context for a single request, which ends with
+// the connection or once the write timeout has passed
+func (s *Server) requestContext(connCtx context.Context) (context.Context, context.CancelFunc) {
+    if s.opts.WriteTimeout > 0 {
+        return context.WithTimeout(connCtx, s.opts.WriteTimeout)
     }
+    return context.WithCancel(connCtx)
+}
+
+// runHandler calls the handler and recovers if it panics. A 500 is sent
+// when the status line hasn't gone out yet; either way the connection is
+// no longer usable and false is returned.
+func (s *Server) runHandler(w *response.Writer, req *request.Request) (ok bool) {
+    defer func() {
+        recovered := recover()
+        if recovered == nil {
+            return
+        }
+        stack := debug.Stack()
+        log.Printf("panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, recovered, stack)
+        if s.opts.OnPanic != nil {
+            s.opts.OnPanic(req, recovered, stack)
+        }
+        // NOTE: a 500 can only go out while the status line hasn't, which
+        // includes a body Write is still holding back
+        w.SetKeepAlive(false)
+        writeErrorResponse(w, response.StatusInternalServerError, "Internal Server Error")
+        ok = false
+    }()
     s.handler(w, req)
-    return
+    return true
+}
+
+// waitForRequest blocks until the next request starts arriving or the
+// idle timeout runs out
+func (s *Server) waitForRequest(conn net.Conn, reader *request.Reader) error {
+    idle := s.opts.IdleTimeout
+    if idle == 0 {
+        idle = s.opts.ReadTimeout
+    }
+    s.setReadDeadline(conn, time.Now(), idle)
+    return reader.WaitForRequest()
+}
+
+func (s *Server) headerTimeout() time.Duration {
+    if s.opts.ReadHeaderTimeout > 0 {
+        return s.opts.ReadHeaderTimeout
+    }
+    return s.opts.ReadTimeout
+}
+
+// setReadDeadline sets the read deadline to from+d, or clears it when d is zero
+func (s *Server) setReadDeadline(conn net.Conn, from time.Time, d time.Duration) {
+    if d > 0 {
+        conn.SetReadDeadline(from.Add(d))
+        return
+    }
+    conn.SetReadDeadline(time.Time{})
+}
+
+func (s *Server) setWriteDeadline(conn net.Conn) {
+    if s.opts.WriteTimeout > 0 {
+        conn.SetWriteDeadline(time.Now().Add(s.opts.WriteTimeout))
+        return
+    }
+    conn.SetWriteDeadline(time.Time{})
+}
+
+// parseErrorResponse picks the status code and message sent back for a
+// request that could not be parsed
+func parseErrorResponse(err error) (response.StatusCode, string) {
+    var perr *request.ParseError
+    if errors.As(err, &perr) {
+        return response.StatusCode(perr.StatusCode()), perr.Kind.String()
+    }
+    return response.StatusBadRequest, "bad request"
 }
 
+// writeError sends a plain text error response on a connection that is
+// about to be closed
+func writeError(conn net.Conn, statusCode response.StatusCode, message string) {
+    writeErrorResponse(response.NewWriter(conn), statusCode, message)
+}
+
+func writeErrorResponse(w *response.Writer, statusCode response.StatusCode, message string) {
+    if err := w.WriteStatusLine(statusCode); err != nil {
+        return
+    }
+    body := []byte(message)
+    w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+    w.WriteBody(body)
+}
+
+// keepAlive decides up front whether the connection should outlive the
+// served-th request on it
+func (s *Server) keepAlive(req *request.Request, served int) bool {
+    if s.closed.Load() {
+        return false
+    }
+    if s.opts.MaxRequestsPerConn > 0 && served >= s.opts.MaxRequestsPerConn {
+        return false
+    }
+    if conn, found := req.Headers.Get("Connection"); found {
+        for _, token := range strings.Split(conn, ",") {
+            if strings.EqualFold(strings.TrimSpace(token), "close") {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+// isConnError reports whether err came from the connection itself (peer
+// went away, idle deadline hit) rather than from a malformed request
+func isConnError(err error) bool {
+    var netErr net.Error
+    return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.As(err, &netErr)
+}
+
+func isTimeout(err error) bool {
+    var netErr net.Error
+    return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Close stops accepting connections and closes all open ones right away,
+// cancelling requests in flight. Use Shutdown to let them finish.
 func (s *Server) Close() error {
     s.closed.Store(true)
+    var err error
     if s.listener != nil {
-        return s.listener.Close()
+        err = s.listener.Close()
+    }
+    s.cancel()
+    s.closeConns(true)
+    return err
+}
+
+// Shutdown stops accepting connections, closes idle keep-alive ones and
+// ones that haven't sent a request yet, and waits for requests in flight
+// to complete, closing each connection as its response is done. When ctx
+// ends first the contexts of the remaining requests are cancelled, their
+// connections closed and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+    s.closed.Store(true)
+    var err error
+    if s.listener != nil {
+        err = s.listener.Close()
+    }
+
+    ticker := time.NewTicker(shutdownPollInterval)
+    defer ticker.Stop()
+    for {
+        if s.closeConns(false) == 0 {
+            s.cancel()
+            return err
+        }
+        select {
+        case <-ctx.Done():
+            s.cancel()
+            s.closeConns(true)
+            return ctx.Err()
+        case <-ticker.C:
+        }
     }
-    return nil
 }
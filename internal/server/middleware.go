@@ -0,0 +1,53 @@
+package server
+
+import (
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+    "github.com/mrtuuro/http-from-tcp/internal/response"
+)
+
+// Middleware wraps a Handler to run code before and after it, or instead
+// of it. The wrapped handler sees the same writer, so a middleware can
+// add response fields through Writer.Header before calling next and read
+// Writer.StatusCode and Writer.BytesWritten once it returns.
+type Middleware func(next Handler) Handler
+
+// Chain composes middleware into one, the first being the outermost:
+// Chain(a, b, c)(h) runs a, then b, then c and finally h.
+func Chain(middleware ...Middleware) Middleware {
+    return func(h Handler) Handler {
+        for i := len(middleware) - 1; i >= 0; i-- {
+            h = middleware[i](h)
+        }
+        return h
+    }
+}
+
+// Compress compresses response bodies for clients that accept gzip or
+// deflate, see response.Writer.EnableCompression
+func Compress(c response.Compression) Middleware {
+    return func(next Handler) Handler {
+        return func(w *response.Writer, req *request.Request) {
+            w.EnableCompression(req, c)
+            next(w, req)
+        }
+    }
+}
+
+// DecodeRequests undoes the gzip and deflate Content-Encoding of request
+// bodies, see request.Request.DecodeBody. Requests sent with any other
+// coding are answered with 415 Unsupported Media Type.
+func DecodeRequests(maxBytes int64) Middleware {
+    return func(next Handler) Handler {
+        return func(w *response.Writer, req *request.Request) {
+            if err := req.DecodeBody(maxBytes); err != nil {
+                // NOTE: RFC 9110 12.5.3 asks a 415 for an unsupported
+                // coding to list the acceptable ones
+                w.Header().Set("Accept-Encoding", "gzip, deflate")
+                code, message := parseErrorResponse(err)
+                writeErrorResponse(w, code, message)
+                return
+            }
+            next(w, req)
+        }
+    }
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+    "bytes"
+    "compress/gzip"
+    "io"
+    "strconv"
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+    "github.com/mrtuuro/http-from-tcp/internal/response"
+)
+
+func TestChain(t *testing.T) {
+    var calls []string
+    trace := func(name string) Middleware {
+        return func(next Handler) Handler {
+            return func(w *response.Writer, req *request.Request) {
+                calls = append(calls, name+" in")
+                next(w, req)
+                calls = append(calls, name+" out")
+            }
+        }
+    }
+    requestID := func(next Handler) Handler {
+        return func(w *response.Writer, req *request.Request) {
+            w.Header().Set("X-Request-ID", "abc")
+            next(w, req)
+        }
+    }
+    var status response.StatusCode
+    var written int64
+    observe := func(next Handler) Handler {
+        return func(w *response.Writer, req *request.Request) {
+            next(w, req)
+            status, written = w.StatusCode(), w.BytesWritten()
+        }
+    }
+    handler := func(w *response.Writer, _ *request.Request) {
+        calls = append(calls, "handler")
+        body := []byte("hello")
+        w.WriteStatusLine(response.StatusCreated)
+        w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+        w.WriteBody(body)
+    }
+
+    req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+    require.NoError(t, err)
+    buf := &bytes.Buffer{}
+    w := response.NewWriter(buf)
+    w.SetKeepAlive(true)
+    Chain(trace("a"), observe, requestID, trace("b"))(handler)(w, req)
+
+    // TEST: First middleware is the outermost
+    assert.Equal(t, []string{"a in", "b in", "handler", "b out", "a out"}, calls)
+
+    // TEST: Middleware can add response fields
+    assert.Equal(t, "HTTP/1.1 201 Created\r\n"+
+        "Content-Length: 5\r\n"+
+        "Content-Type: text/plain\r\n"+
+        "X-Request-ID: abc\r\n"+
+        "\r\n"+
+        "hello", buf.String())
+
+    // TEST: Middleware can observe the response
+    assert.Equal(t, response.StatusCreated, status)
+    assert.Equal(t, int64(5), written)
+
+    // TEST: Empty chain returns the handler itself
+    calls = nil
+    Chain()(handler)(response.NewWriter(&bytes.Buffer{}), req)
+    assert.Equal(t, []string{"handler"}, calls)
+}
+
+func TestDecodeRequests(t *testing.T) {
+    var got string
+    handler := DecodeRequests(1 << 20)(func(w *response.Writer, req *request.Request) {
+        body, _ := io.ReadAll(req.Body)
+        got = string(body)
+        w.WriteStatusLine(response.StatusOK)
+        w.WriteHeaders(response.GetDefaultHeaders(0))
+    })
+
+    // TEST: gzip bodies reach the handler decoded
+    gzipped := &bytes.Buffer{}
+    gw := gzip.NewWriter(gzipped)
+    gw.Write([]byte("hello"))
+    gw.Close()
+    req, err := request.RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Encoding: gzip\r\nContent-Length: " +
+        strconv.Itoa(gzipped.Len()) + "\r\n\r\n" + gzipped.String()))
+    require.NoError(t, err)
+    w := response.NewWriter(&bytes.Buffer{})
+    handler(w, req)
+    assert.Equal(t, response.StatusOK, w.StatusCode())
+    assert.Equal(t, "hello", got)
+
+    // TEST: Unknown codings get 415
+    req, err = request.RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Encoding: br\r\nContent-Length: 5\r\n\r\nhello"))
+    require.NoError(t, err)
+    buf := &bytes.Buffer{}
+    handler(response.NewWriter(buf), req)
+    assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 415 Unsupported Media Type\r\n"), buf.String())
+    assert.Contains(t, buf.String(), "\r\nAccept-Encoding: gzip, deflate\r\n")
+}
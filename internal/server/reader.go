@@ -0,0 +1,122 @@
+package server
+
+import (
+    "context"
+    "errors"
+    "io"
+    "net"
+    "sync"
+    "time"
+)
+
+// aLongTimeAgo is a read deadline in the past, used to unblock a read
+var aLongTimeAgo = time.Unix(1, 0)
+
+// connReader sits between the connection and request.Reader. While a
+// handler runs on a request without a body, or one whose body it read to
+// the end, it keeps a one byte read pending on the connection, so that the
+// client hanging up cancels the request context. A byte read that way
+// belongs to the next request and is handed back on the following Read.
+type connReader struct {
+    conn   net.Conn
+    cancel context.CancelFunc
+
+    mu      sync.Mutex
+    cond    *sync.Cond
+    inRead  bool
+    aborted bool
+    hasByte bool
+    byteBuf [1]byte
+    err     error
+}
+
+func newConnReader(conn net.Conn, cancel context.CancelFunc) *connReader {
+    cr := &connReader{conn: conn, cancel: cancel}
+    cr.cond = sync.NewCond(&cr.mu)
+    return cr
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+    cr.mu.Lock()
+    if cr.inRead {
+        cr.mu.Unlock()
+        return 0, errors.New("concurrent read on connection")
+    }
+    if cr.err != nil {
+        err := cr.err
+        cr.mu.Unlock()
+        return 0, err
+    }
+    if cr.hasByte && len(p) > 0 {
+        p[0] = cr.byteBuf[0]
+        cr.hasByte = false
+        cr.mu.Unlock()
+        return 1, nil
+    }
+    cr.mu.Unlock()
+    return cr.conn.Read(p)
+}
+
+// startBackgroundRead starts watching the connection for the client going
+// away. Nothing else may read from the connection until abortPendingRead.
+func (cr *connReader) startBackgroundRead() {
+    cr.mu.Lock()
+    defer cr.mu.Unlock()
+    if cr.inRead || cr.hasByte || cr.err != nil {
+        return
+    }
+    cr.inRead = true
+    cr.conn.SetReadDeadline(time.Time{})
+    go cr.backgroundRead()
+}
+
+func (cr *connReader) backgroundRead() {
+    n, err := cr.conn.Read(cr.byteBuf[:])
+    cr.mu.Lock()
+    if n == 1 {
+        cr.hasByte = true
+    }
+    var netErr net.Error
+    if errors.As(err, &netErr) && netErr.Timeout() && cr.aborted {
+        // NOTE: unblocked on purpose by abortPendingRead, not an error
+    } else if err != nil {
+        cr.err = err
+        cr.cancel()
+    }
+    cr.aborted = false
+    cr.inRead = false
+    cr.mu.Unlock()
+    cr.cond.Broadcast()
+}
+
+// abortPendingRead stops the background read, if any, and waits for it
+func (cr *connReader) abortPendingRead() {
+    cr.mu.Lock()
+    defer cr.mu.Unlock()
+    if !cr.inRead {
+        return
+    }
+    cr.aborted = true
+    cr.conn.SetReadDeadline(aLongTimeAgo)
+    for cr.inRead {
+        cr.cond.Wait()
+    }
+    cr.conn.SetReadDeadline(time.Time{})
+}
+
+// eofBody starts the background read once the handler has read the body
+// to the end, nothing more of the request is left on the connection then
+type eofBody struct {
+    io.ReadCloser
+    cr      *connReader
+    watched bool
+}
+
+func (b *eofBody) Read(p []byte) (int, error) {
+    n, err := b.ReadCloser.Read(p)
+    if err == io.EOF && !b.watched {
+        b.watched = true
+        b.cr.startBackgroundRead()
+    }
+    return n, err
+}
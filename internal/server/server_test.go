@@ -0,0 +1,547 @@
+package server
+
+import (
+    "bufio"
+    "context"
+    "fmt"
+    "io"
+    "net"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/mrtuuro/http-from-tcp/internal/headers"
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+    "github.com/mrtuuro/http-from-tcp/internal/response"
+)
+
+// roundTrip serves raw on an in-memory connection and returns everything
+// the server wrote before closing it
+func roundTrip(t *testing.T, s *Server, raw string) string {
+    t.Helper()
+    client, conn := net.Pipe()
+    go s.handle(conn)
+    defer client.Close()
+
+    client.SetDeadline(time.Now().Add(2 * time.Second))
+    go client.Write([]byte(raw))
+    out, err := io.ReadAll(client)
+    require.NoError(t, err)
+    return string(out)
+}
+
+func TestPanicRecovery(t *testing.T) {
+    var recovered any
+    var stack []byte
+    opts := Options{
+        OnPanic: func(_ *request.Request, v any, s []byte) {
+            recovered, stack = v, s
+        },
+    }
+
+    // TEST: Panic before the status line is turned into a 500
+    s := NewServerWithOptions(func(w *response.Writer, _ *request.Request) {
+        panic("boom")
+    }, opts)
+    out := roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+    assert.Equal(t, "HTTP/1.1 500 Internal Server Error\r\n"+
+        "Content-Length: 21\r\n"+
+        "Content-Type: text/plain\r\n"+
+        "Connection: close\r\n"+
+        "\r\n"+
+        "Internal Server Error", out)
+    assert.Equal(t, "boom", recovered)
+    assert.Contains(t, string(stack), "TestPanicRecovery")
+
+    // TEST: Panic after the status line aborts the connection
+    s = NewServerWithOptions(func(w *response.Writer, _ *request.Request) {
+        w.WriteStatusLine(response.StatusOK)
+        panic("late boom")
+    }, opts)
+    out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\nGET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+    assert.Equal(t, "HTTP/1.1 200 OK\r\n", out)
+    assert.Equal(t, "late boom", recovered)
+
+    // TEST: A body Write still holds back is replaced by the 500
+    s = NewServerWithOptions(func(w *response.Writer, _ *request.Request) {
+        w.Write([]byte("partial"))
+        panic("buffered boom")
+    }, opts)
+    out = roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 500 Internal Server Error\r\n"), out)
+    assert.NotContains(t, out, "partial")
+}
+
+func TestShutdown(t *testing.T) {
+    started := make(chan struct{})
+    release := make(chan struct{})
+    s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+        if req.RequestLine.RequestTarget == "/slow" {
+            close(started)
+            <-release
+        }
+        w.WriteStatusLine(response.StatusOK)
+        w.WriteHeaders(response.GetDefaultHeaders(0))
+    })
+    require.NoError(t, err)
+    addr := s.listener.Addr().String()
+
+    // NOTE: one idle keep-alive connection and one busy connection
+    idle, err := net.Dial("tcp", addr)
+    require.NoError(t, err)
+    defer idle.Close()
+    idle.SetDeadline(time.Now().Add(2 * time.Second))
+    idle.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+    idleReader := bufio.NewReader(idle)
+    line, err := idleReader.ReadString('\n')
+    require.NoError(t, err)
+    assert.Equal(t, "HTTP/1.1 200 OK\r\n", line)
+
+    busy, err := net.Dial("tcp", addr)
+    require.NoError(t, err)
+    defer busy.Close()
+    busy.SetDeadline(time.Now().Add(2 * time.Second))
+    busy.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+    <-started
+
+    done := make(chan error, 1)
+    go func() { done <- s.Shutdown(context.Background()) }()
+
+    // TEST: Idle connections are closed right away
+    rest, err := io.ReadAll(idleReader)
+    require.NoError(t, err)
+    assert.Contains(t, string(rest), "\r\n\r\n")
+
+    // TEST: New connections are refused
+    _, err = net.Dial("tcp", addr)
+    assert.Error(t, err)
+
+    // TEST: Shutdown waits for requests in flight
+    select {
+    case err := <-done:
+        t.Fatalf("Shutdown returned early: %v", err)
+    case <-time.After(100 * time.Millisecond):
+    }
+    close(release)
+
+    // TEST: The busy connection is closed once its response is done
+    out, err := io.ReadAll(busy)
+    require.NoError(t, err)
+    assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+        "Content-Length: 0\r\n"+
+        "Content-Type: text/plain\r\n"+
+        "\r\n", string(out))
+    assert.NoError(t, <-done)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+    release := make(chan struct{})
+    defer close(release)
+    started := make(chan struct{})
+    s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+        close(started)
+        <-release
+    })
+    require.NoError(t, err)
+
+    conn, err := net.Dial("tcp", s.listener.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(2 * time.Second))
+    conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+    <-started
+
+    // TEST: Connections still active at the deadline are force-closed
+    ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+    defer cancel()
+    err = s.Shutdown(ctx)
+    assert.ErrorIs(t, err, context.DeadlineExceeded)
+    out, err := io.ReadAll(conn)
+    require.NoError(t, err)
+    assert.Empty(t, out)
+}
+
+func TestShutdownSilentClient(t *testing.T) {
+    s, err := Serve(0, okHandler)
+    require.NoError(t, err)
+
+    conn, err := net.Dial("tcp", s.listener.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(2 * time.Second))
+    // NOTE: wait for the server to pick the connection up
+    require.Eventually(t, func() bool {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        return len(s.conns) == 1
+    }, time.Second, 5*time.Millisecond)
+
+    // TEST: A connection that never sent a request doesn't hold Shutdown up
+    ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+    defer cancel()
+    assert.NoError(t, s.Shutdown(ctx))
+    out, err := io.ReadAll(conn)
+    require.NoError(t, err)
+    assert.Empty(t, out)
+}
+
+func TestRequestContext(t *testing.T) {
+    // TEST: Client hanging up cancels the request context
+    cancelled := make(chan error, 1)
+    s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+        select {
+        case <-req.Context().Done():
+            cancelled <- req.Context().Err()
+        case <-time.After(2 * time.Second):
+            cancelled <- nil
+        }
+    })
+    require.NoError(t, err)
+    defer s.Close()
+    conn, err := net.Dial("tcp", s.listener.Addr().String())
+    require.NoError(t, err)
+    conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+    time.Sleep(50 * time.Millisecond)
+    conn.Close()
+    assert.ErrorIs(t, <-cancelled, context.Canceled)
+
+    // TEST: Client hanging up after the body was read cancels it too
+    s, err = Serve(0, func(w *response.Writer, req *request.Request) {
+        body, err := io.ReadAll(req.Body)
+        if err != nil || string(body) != "abc" {
+            cancelled <- fmt.Errorf("read body %q: %v", body, err)
+            return
+        }
+        select {
+        case <-req.Context().Done():
+            cancelled <- req.Context().Err()
+        case <-time.After(2 * time.Second):
+            cancelled <- nil
+        }
+    })
+    require.NoError(t, err)
+    defer s.Close()
+    conn, err = net.Dial("tcp", s.listener.Addr().String())
+    require.NoError(t, err)
+    conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nabc"))
+    time.Sleep(50 * time.Millisecond)
+    conn.Close()
+    assert.ErrorIs(t, <-cancelled, context.Canceled)
+
+    // TEST: Pipelined requests survive the disconnect watch, also after a
+    // body
+    s = NewServer(func(w *response.Writer, req *request.Request) {
+        io.ReadAll(req.Body)
+        time.Sleep(20 * time.Millisecond)
+        assert.NoError(t, req.Context().Err())
+        body := []byte(req.RequestLine.RequestTarget)
+        w.WriteStatusLine(response.StatusOK)
+        w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+        w.WriteBody(body)
+    })
+    out := roundTrip(t, s, "POST /zero HTTP/1.1\r\nHost: localhost\r\nContent-Length: 2\r\n\r\nhi"+
+        "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+        "GET /two HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+    assert.Contains(t, out, "\r\n\r\n/zeroHTTP/1.1 200 OK\r\n")
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\n/one"+
+        "HTTP/1.1 200 OK\r\n"+
+        "Content-Length: 4\r\n"+
+        "Content-Type: text/plain\r\n"+
+        "Connection: close\r\n"+
+        "\r\n"+
+        "/two"), out)
+
+    // TEST: Write timeout is the context deadline
+    s = NewServerWithOptions(func(w *response.Writer, req *request.Request) {
+        <-req.Context().Done()
+        cancelled <- req.Context().Err()
+    }, Options{WriteTimeout: 50 * time.Millisecond})
+    roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+    assert.ErrorIs(t, <-cancelled, context.DeadlineExceeded)
+
+    // TEST: Requests with a body are cancelled when the server closes
+    started := make(chan struct{})
+    s, err = Serve(0, func(w *response.Writer, req *request.Request) {
+        close(started)
+        <-req.Context().Done()
+        cancelled <- req.Context().Err()
+    })
+    require.NoError(t, err)
+    conn, err = net.Dial("tcp", s.listener.Addr().String())
+    require.NoError(t, err)
+    defer conn.Close()
+    conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nabc"))
+    <-started
+    s.Close()
+    assert.ErrorIs(t, <-cancelled, context.Canceled)
+}
+
+func TestConnLimits(t *testing.T) {
+    release := make(chan struct{})
+    started := make(chan struct{}, 10)
+    blocking := func(w *response.Writer, req *request.Request) {
+        started <- struct{}{}
+        <-release
+        okHandler(w, req)
+    }
+    dial := func(s *Server) net.Conn {
+        conn, err := net.Dial("tcp", s.listener.Addr().String())
+        require.NoError(t, err)
+        conn.SetDeadline(time.Now().Add(2 * time.Second))
+        conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+        return conn
+    }
+    readAll := func(conn net.Conn) string {
+        out, _ := io.ReadAll(conn)
+        conn.Close()
+        return string(out)
+    }
+
+    // TEST: Over MaxConns clients wait until a connection frees up
+    s, err := ServeWithOptions(0, blocking, Options{MaxConns: 1})
+    require.NoError(t, err)
+    first := dial(s)
+    <-started
+    second := dial(s)
+    select {
+    case <-started:
+        t.Fatal("second connection served while over the limit")
+    case <-time.After(100 * time.Millisecond):
+    }
+    release <- struct{}{}
+    assert.Contains(t, readAll(first), "\r\n\r\nok")
+    <-started
+    release <- struct{}{}
+    assert.Contains(t, readAll(second), "\r\n\r\nok")
+    s.Close()
+
+    // TEST: With RetryAfter clients over MaxConns get a 503 right away
+    s, err = ServeWithOptions(0, blocking, Options{MaxConns: 1, RetryAfter: 1500 * time.Millisecond})
+    require.NoError(t, err)
+    first = dial(s)
+    <-started
+    out := readAll(dial(s))
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 503 Service Unavailable\r\n"), out)
+    assert.Contains(t, out, "\r\nRetry-After: 2\r\n")
+    release <- struct{}{}
+    assert.Contains(t, readAll(first), "\r\n\r\nok")
+    s.Close()
+
+    // TEST: Connections per client IP
+    s, err = ServeWithOptions(0, blocking, Options{MaxConnsPerIP: 1})
+    require.NoError(t, err)
+    first = dial(s)
+    <-started
+    out = readAll(dial(s))
+    assert.True(t, strings.HasPrefix(out, "HTTP/1.1 503 Service Unavailable\r\n"), out)
+    assert.Contains(t, out, "\r\nRetry-After: 1\r\n")
+    release <- struct{}{}
+    assert.Contains(t, readAll(first), "\r\n\r\nok")
+    // NOTE: the slot is freed once the first connection is gone
+    time.Sleep(50 * time.Millisecond)
+    second = dial(s)
+    <-started
+    release <- struct{}{}
+    assert.Contains(t, readAll(second), "\r\n\r\nok")
+    s.Close()
+}
+
+func TestWorkers(t *testing.T) {
+    var mu sync.Mutex
+    running, peak := 0, 0
+    s, err := ServeWithOptions(0, func(w *response.Writer, req *request.Request) {
+        mu.Lock()
+        running++
+        peak = max(peak, running)
+        mu.Unlock()
+        time.Sleep(30 * time.Millisecond)
+        mu.Lock()
+        running--
+        mu.Unlock()
+        okHandler(w, req)
+    }, Options{Workers: 2})
+    require.NoError(t, err)
+    defer s.Close()
+
+    // TEST: No more than Workers handlers run at once
+    var wg sync.WaitGroup
+    for range 6 {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            assert.Contains(t, get(t, "tcp", s.listener.Addr().String()), "\r\n\r\nok")
+        }()
+    }
+    wg.Wait()
+    assert.Equal(t, 2, peak)
+}
+
+func TestUnfinishedChunkedBody(t *testing.T) {
+    s := NewServerWithOptions(func(w *response.Writer, _ *request.Request) {
+        w.WriteStatusLine(response.StatusOK)
+        h := headers.NewHeaders()
+        h.Set("Transfer-Encoding", "chunked")
+        w.WriteHeaders(h)
+        w.WriteChunkedBody([]byte("hi"))
+    }, Options{})
+
+    // TEST: The server ends the body and keeps the connection
+    out := roundTrip(t, s, "GET /1 HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+        "GET /2 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+    assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+        "Transfer-Encoding: chunked\r\n"+
+        "\r\n"+
+        "2\r\nhi\r\n0\r\n\r\n"+
+        "HTTP/1.1 200 OK\r\n"+
+        "Transfer-Encoding: chunked\r\n"+
+        "Connection: close\r\n"+
+        "\r\n"+
+        "2\r\nhi\r\n0\r\n\r\n", out)
+}
+
+func TestContentLengthUnderrun(t *testing.T) {
+    s := NewServerWithOptions(func(w *response.Writer, _ *request.Request) {
+        w.Header().Set("Content-Length", "10")
+        w.Write([]byte("short"))
+    }, Options{})
+
+    // TEST: A body shorter than announced aborts the connection
+    out := roundTrip(t, s, "GET /1 HTTP/1.1\r\nHost: localhost\r\n\r\nGET /2 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+    assert.Equal(t, 1, strings.Count(out, "HTTP/1.1 200 OK\r\n"), out)
+    assert.True(t, strings.HasSuffix(out, "\r\n\r\nshort"), out)
+}
+
+func TestEmptyResponse(t *testing.T) {
+    s := NewServerWithOptions(func(w *response.Writer, _ *request.Request) {}, Options{})
+
+    // TEST: A handler that writes nothing answers 200 and keeps the connection
+    out := roundTrip(t, s, "GET /1 HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+        "GET /2 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+    assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+        "Content-Length: 0\r\n"+
+        "\r\n"+
+        "HTTP/1.1 200 OK\r\n"+
+        "Content-Length: 0\r\n"+
+        "Connection: close\r\n"+
+        "\r\n", out)
+}
+
+func TestTimeouts(t *testing.T) {
+    bodyErr := make(chan error, 1)
+    handler := func(w *response.Writer, req *request.Request) {
+        if req.Body != request.NoBody {
+            _, err := io.ReadAll(req.Body)
+            bodyErr <- err
+        }
+        w.Write([]byte("ok"))
+    }
+    s, err := ServeWithOptions(0, handler, Options{
+        ReadHeaderTimeout: 100 * time.Millisecond,
+        ReadTimeout:       500 * time.Millisecond,
+        IdleTimeout:       200 * time.Millisecond,
+    })
+    require.NoError(t, err)
+    defer s.Close()
+    dial := func(raw string) (net.Conn, time.Time) {
+        conn, err := net.Dial("tcp", s.listener.Addr().String())
+        require.NoError(t, err)
+        conn.SetDeadline(time.Now().Add(2 * time.Second))
+        conn.Write([]byte(raw))
+        return conn, time.Now()
+    }
+
+    // TEST: A header that doesn't arrive in time gets a 408 and the connection closes
+    conn, start := dial("GET / HTTP/1.1\r\nHost: local")
+    out, err := io.ReadAll(conn)
+    conn.Close()
+    require.NoError(t, err)
+    assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 408 Request Timeout\r\n"), string(out))
+    assert.Contains(t, string(out), "\r\n\r\nRequest timed out")
+    assert.Less(t, time.Since(start), time.Second)
+
+    // TEST: An idle keep-alive connection closes after IdleTimeout
+    conn, _ = dial("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+    br := bufio.NewReader(conn)
+    line, err := br.ReadString('\n')
+    require.NoError(t, err)
+    assert.Equal(t, "HTTP/1.1 200 OK\r\n", line)
+    for line != "\r\n" {
+        line, err = br.ReadString('\n')
+        require.NoError(t, err)
+    }
+    rest := make([]byte, 2)
+    _, err = io.ReadFull(br, rest)
+    require.NoError(t, err)
+    assert.Equal(t, "ok", string(rest))
+    idleStart := time.Now()
+    out, err = io.ReadAll(br)
+    conn.Close()
+    require.NoError(t, err)
+    assert.Empty(t, out)
+    assert.GreaterOrEqual(t, time.Since(idleStart), 150*time.Millisecond)
+    // NOTE: well short of ReadTimeout, which IdleTimeout would fall back to
+    assert.Less(t, time.Since(idleStart), 400*time.Millisecond)
+
+    // TEST: A body that stalls runs into ReadTimeout and the connection closes
+    conn, start = dial("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc")
+    select {
+    case err = <-bodyErr:
+        assert.True(t, isTimeout(err), "%v", err)
+        assert.GreaterOrEqual(t, time.Since(start), 450*time.Millisecond)
+    case <-time.After(1500 * time.Millisecond):
+        t.Fatal("body read did not time out")
+    }
+    out, err = io.ReadAll(conn)
+    conn.Close()
+    require.NoError(t, err)
+    assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n"), string(out))
+}
+
+func TestKeepAlive(t *testing.T) {
+    handler := func(w *response.Writer, req *request.Request) {
+        if req.RequestLine.RequestTarget == "/close" {
+            w.Header().Set("Connection", "close")
+        }
+        w.Write([]byte(req.RequestLine.RequestTarget))
+    }
+    ok := func(body string) string {
+        return fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+    }
+    closing := func(body string) string {
+        return fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+    }
+    s := NewServerWithOptions(handler, Options{})
+
+    // TEST: Pipelined requests are answered in order on the same connection
+    out := roundTrip(t, s, "GET /1 HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+        "GET /2 HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+        "GET /3 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+    assert.Equal(t, ok("/1")+ok("/2")+closing("/3"), out)
+
+    // TEST: Connection: close from the client ends the connection after its response
+    out = roundTrip(t, s, "GET /1 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"+
+        "GET /2 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+    assert.Equal(t, closing("/1"), out)
+
+    // TEST: Connection: close from the handler does the same
+    out = roundTrip(t, s, "GET /close HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+        "GET /2 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+    assert.Equal(t, closing("/close"), out)
+
+    // TEST: An unread body is skipped before the next request
+    out = roundTrip(t, s, "POST /1 HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello world"+
+        "POST /2 HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"+
+        "GET /3 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+    assert.Equal(t, ok("/1")+ok("/2")+closing("/3"), out)
+
+    // TEST: MaxRequestsPerConn closes the connection after that many responses
+    s = NewServerWithOptions(handler, Options{MaxRequestsPerConn: 2})
+    out = roundTrip(t, s, "GET /1 HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+        "GET /2 HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+        "GET /3 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+    assert.Equal(t, ok("/1")+closing("/2"), out)
+}
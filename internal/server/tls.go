@@ -0,0 +1,199 @@
+package server
+
+import (
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// ServeTLS serves HTTPS on port with a single certificate, reloaded from
+// certFile and keyFile whenever they change on disk
+func ServeTLS(port int, handler Handler, certFile, keyFile string) (*Server, error) {
+    store := NewCertStore()
+    if err := store.Add(certFile, keyFile); err != nil {
+        return nil, err
+    }
+    return ServeTLSWithOptions(port, handler, Options{}, store.TLSConfig())
+}
+
+// ServeTLSWithOptions serves HTTPS on port using config, which must provide
+// certificates through Certificates or GetCertificate. Set ClientAuth and
+// ClientCAs on it for mutual TLS; the verified client certificates are
+// then found in Request.TLS.
+func ServeTLSWithOptions(port int, handler Handler, opts Options, config *tls.Config) (*Server, error) {
+    if config == nil || len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+        return nil, errors.New("tls config has no certificates")
+    }
+    l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+    if err != nil {
+        return nil, err
+    }
+    return ServeListener(tls.NewListener(l, config), handler, opts), nil
+}
+
+// CertStore holds certificates loaded from PEM files and picks one for
+// each handshake by the server name the client asked for (SNI). Files are
+// checked for changes at most once per ReloadInterval and reloaded in
+// place, so renewed certificates are served without a restart.
+type CertStore struct {
+    // ReloadInterval is how often the files are checked for changes, zero
+    // means on every handshake
+    ReloadInterval time.Duration
+
+    mu    sync.RWMutex
+    pairs []*certPair
+}
+
+type certPair struct {
+    certFile string
+    keyFile  string
+    cert     *tls.Certificate
+    names    []string
+    modTime  time.Time
+    checked  time.Time
+}
+
+func NewCertStore() *CertStore {
+    return &CertStore{ReloadInterval: 10 * time.Second}
+}
+
+// Add loads a certificate and key pair. The certificate is served for the
+// DNS names it is valid for; the first one added is the fallback for
+// clients not sending a known server name.
+func (cs *CertStore) Add(certFile, keyFile string) error {
+    pair := &certPair{certFile: certFile, keyFile: keyFile}
+    if err := pair.load(); err != nil {
+        return err
+    }
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    cs.pairs = append(cs.pairs, pair)
+    return nil
+}
+
+// TLSConfig returns a server config serving certificates from cs
+func (cs *CertStore) TLSConfig() *tls.Config {
+    return &tls.Config{
+        GetCertificate: cs.GetCertificate,
+        MinVersion:     tls.VersionTLS12,
+    }
+}
+
+// GetCertificate is a tls.Config.GetCertificate callback. It prefers an
+// exact name match, then a wildcard certificate, then the first one added.
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+    cs.reloadChanged()
+
+    cs.mu.RLock()
+    defer cs.mu.RUnlock()
+    if len(cs.pairs) == 0 {
+        return nil, errors.New("no certificates loaded")
+    }
+    name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+    if name != "" {
+        if pair := cs.lookup(name); pair != nil {
+            return pair.cert, nil
+        }
+        if i := strings.IndexByte(name, '.'); i != -1 {
+            if pair := cs.lookup("*" + name[i:]); pair != nil {
+                return pair.cert, nil
+            }
+        }
+    }
+    return cs.pairs[0].cert, nil
+}
+
+func (cs *CertStore) lookup(name string) *certPair {
+    for _, pair := range cs.pairs {
+        for _, n := range pair.names {
+            if n == name {
+                return pair
+            }
+        }
+    }
+    return nil
+}
+
+// reloadChanged reloads the pairs whose files changed since they were
+// loaded. A pair failing to load keeps serving its previous certificate.
+func (cs *CertStore) reloadChanged() {
+    // NOTE: runs on every handshake, the write lock is only taken when a
+    // check is due so handshakes don't queue up behind each other
+    if !cs.reloadDue(time.Now()) {
+        return
+    }
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    now := time.Now()
+    for _, pair := range cs.pairs {
+        if now.Sub(pair.checked) < cs.ReloadInterval {
+            continue
+        }
+        pair.checked = now
+        modTime, err := pair.latestModTime()
+        if err != nil || !modTime.After(pair.modTime) {
+            continue
+        }
+        if err := pair.load(); err != nil {
+            log.Printf("Error reloading certificate %s: %v", pair.certFile, err)
+        }
+    }
+}
+
+// reloadDue reports whether any pair is due for a check at now
+func (cs *CertStore) reloadDue(now time.Time) bool {
+    cs.mu.RLock()
+    defer cs.mu.RUnlock()
+    for _, pair := range cs.pairs {
+        if now.Sub(pair.checked) >= cs.ReloadInterval {
+            return true
+        }
+    }
+    return false
+}
+
+func (p *certPair) load() error {
+    modTime, err := p.latestModTime()
+    if err != nil {
+        return err
+    }
+    cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+    if err != nil {
+        return err
+    }
+
+    names := cert.Leaf.DNSNames
+    if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+        names = []string{cert.Leaf.Subject.CommonName}
+    }
+    p.names = p.names[:0]
+    for _, n := range names {
+        p.names = append(p.names, strings.ToLower(n))
+    }
+    p.cert = &cert
+    p.modTime = modTime
+    p.checked = time.Now()
+    return nil
+}
+
+// latestModTime returns the newest modification time of the two files
+func (p *certPair) latestModTime() (time.Time, error) {
+    certInfo, err := os.Stat(p.certFile)
+    if err != nil {
+        return time.Time{}, err
+    }
+    keyInfo, err := os.Stat(p.keyFile)
+    if err != nil {
+        return time.Time{}, err
+    }
+    if keyInfo.ModTime().After(certInfo.ModTime()) {
+        return keyInfo.ModTime(), nil
+    }
+    return certInfo.ModTime(), nil
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "io"
+    "math/big"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+    "github.com/mrtuuro/http-from-tcp/internal/response"
+)
+
+// writeCert writes a self-signed certificate for names into dir and
+// returns the paths of the certificate and key files
+func writeCert(t *testing.T, dir, cn string, names ...string) (string, string) {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    require.NoError(t, err)
+    serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+    require.NoError(t, err)
+    tmpl := &x509.Certificate{
+        SerialNumber:          serial,
+        Subject:               pkix.Name{CommonName: cn},
+        DNSNames:              names,
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(time.Hour),
+        KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+    require.NoError(t, err)
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    require.NoError(t, err)
+
+    certFile := filepath.Join(dir, cn+".crt")
+    keyFile := filepath.Join(dir, cn+".key")
+    require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+    require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+    return certFile, keyFile
+}
+
+// peerName connects to s, asking for serverName, and returns the common
+// name of the certificate the server presented
+func peerName(t *testing.T, s *Server, serverName string) string {
+    t.Helper()
+    conn, err := tls.Dial("tcp", s.listener.Addr().String(), &tls.Config{
+        ServerName:         serverName,
+        InsecureSkipVerify: true,
+    })
+    require.NoError(t, err)
+    defer conn.Close()
+    return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertStore(t *testing.T) {
+    dir := t.TempDir()
+    store := NewCertStore()
+    store.ReloadInterval = 0
+    require.NoError(t, store.Add(writeCert(t, dir, "default", "example.com")))
+    require.NoError(t, store.Add(writeCert(t, dir, "api", "api.example.com")))
+    require.NoError(t, store.Add(writeCert(t, dir, "wildcard", "*.apps.example.com")))
+
+    s, err := ServeTLSWithOptions(0, func(w *response.Writer, _ *request.Request) {}, Options{}, store.TLSConfig())
+    require.NoError(t, err)
+    defer s.Close()
+
+    // TEST: Certificate picked by server name
+    assert.Equal(t, "api", peerName(t, s, "api.example.com"))
+    assert.Equal(t, "default", peerName(t, s, "example.com"))
+
+    // TEST: Wildcard certificate
+    assert.Equal(t, "wildcard", peerName(t, s, "shop.apps.example.com"))
+
+    // TEST: Unknown or missing server name falls back to the first one
+    assert.Equal(t, "default", peerName(t, s, "other.test"))
+    assert.Equal(t, "default", peerName(t, s, ""))
+
+    // TEST: Changed files are reloaded
+    certFile, keyFile := writeCert(t, t.TempDir(), "api", "api.example.com")
+    renewed, err := os.ReadFile(certFile)
+    require.NoError(t, err)
+    renewedKey, err := os.ReadFile(keyFile)
+    require.NoError(t, err)
+    require.NoError(t, os.WriteFile(filepath.Join(dir, "api.crt"), renewed, 0o600))
+    require.NoError(t, os.WriteFile(filepath.Join(dir, "api.key"), renewedKey, 0o600))
+    later := time.Now().Add(time.Minute)
+    require.NoError(t, os.Chtimes(filepath.Join(dir, "api.crt"), later, later))
+
+    conn, err := tls.Dial("tcp", s.listener.Addr().String(), &tls.Config{
+        ServerName:         "api.example.com",
+        InsecureSkipVerify: true,
+    })
+    require.NoError(t, err)
+    defer conn.Close()
+    block, _ := pem.Decode(renewed)
+    assert.Equal(t, block.Bytes, conn.ConnectionState().PeerCertificates[0].Raw)
+
+    // TEST: Broken files keep the previous certificate
+    require.NoError(t, os.WriteFile(filepath.Join(dir, "api.crt"), []byte("garbage"), 0o600))
+    later = later.Add(time.Minute)
+    require.NoError(t, os.Chtimes(filepath.Join(dir, "api.crt"), later, later))
+    assert.Equal(t, "api", peerName(t, s, "api.example.com"))
+
+    // TEST: Missing files fail up front
+    assert.Error(t, NewCertStore().Add(filepath.Join(dir, "nope.crt"), filepath.Join(dir, "nope.key")))
+}
+
+func TestCertStoreReadLock(t *testing.T) {
+    store := NewCertStore()
+    require.NoError(t, store.Add(writeCert(t, t.TempDir(), "default", "example.com")))
+
+    // TEST: Handshakes between reload checks only need the read lock
+    store.mu.RLock()
+    done := make(chan *tls.Certificate)
+    go func() {
+        cert, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+        done <- cert
+    }()
+    select {
+    case cert := <-done:
+        assert.NotNil(t, cert)
+    case <-time.After(2 * time.Second):
+        t.Fatal("GetCertificate blocked on the store lock")
+    }
+    store.mu.RUnlock()
+
+    // TEST: A due check still reloads
+    store.ReloadInterval = 0
+    assert.True(t, store.reloadDue(time.Now()))
+    store.ReloadInterval = time.Hour
+    assert.False(t, store.reloadDue(time.Now()))
+}
+
+func TestServeTLS(t *testing.T) {
+    dir := t.TempDir()
+    certFile, keyFile := writeCert(t, dir, "localhost", "localhost")
+    clientCertFile, clientKeyFile := writeCert(t, dir, "client")
+
+    serverCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+    require.NoError(t, err)
+    clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+    require.NoError(t, err)
+    roots := x509.NewCertPool()
+    roots.AddCert(serverCert.Leaf)
+    clientCAs := x509.NewCertPool()
+    clientCAs.AddCert(clientCert.Leaf)
+
+    handler := func(w *response.Writer, req *request.Request) {
+        body := []byte("plain")
+        if req.TLS != nil {
+            body = []byte(tls.VersionName(req.TLS.Version))
+            if len(req.TLS.PeerCertificates) > 0 {
+                body = append(body, " "+req.TLS.PeerCertificates[0].Subject.CommonName...)
+            }
+        }
+        w.WriteStatusLine(response.StatusOK)
+        h := response.GetDefaultHeaders(len(body))
+        h.Set("Connection", "close")
+        w.WriteHeaders(h)
+        w.WriteBody(body)
+    }
+    get := func(s *Server, config *tls.Config) (string, error) {
+        conn, err := tls.Dial("tcp", s.listener.Addr().String(), config)
+        if err != nil {
+            return "", err
+        }
+        defer conn.Close()
+        conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+        out, err := io.ReadAll(conn)
+        return string(out), err
+    }
+
+    // TEST: Certificate and key paths
+    s, err := ServeTLS(0, handler, certFile, keyFile)
+    require.NoError(t, err)
+    out, err := get(s, &tls.Config{RootCAs: roots, ServerName: "localhost", MaxVersion: tls.VersionTLS12})
+    require.NoError(t, err)
+    assert.Contains(t, out, "\r\n\r\nTLS 1.2")
+    s.Close()
+
+    // TEST: Mutual TLS exposes the client certificate
+    s, err = ServeTLSWithOptions(0, handler, Options{}, &tls.Config{
+        Certificates: []tls.Certificate{serverCert},
+        ClientAuth:   tls.RequireAndVerifyClientCert,
+        ClientCAs:    clientCAs,
+    })
+    require.NoError(t, err)
+    defer s.Close()
+    out, err = get(s, &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: []tls.Certificate{clientCert}})
+    require.NoError(t, err)
+    assert.Contains(t, out, "\r\n\r\nTLS 1.3 client")
+
+    // TEST: Clients without a certificate are rejected
+    out, err = get(s, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+    assert.Empty(t, out)
+    assert.Error(t, err)
+
+    // TEST: Config without certificates
+    _, err = ServeTLSWithOptions(0, handler, Options{}, &tls.Config{})
+    assert.Error(t, err)
+}
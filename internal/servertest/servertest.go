@@ -0,0 +1,39 @@
+package servertest
+
+import (
+    "bytes"
+    "net"
+    "strings"
+    "testing"
+
+    "github.com/stretchr/testify/require"
+
+    "github.com/mrtuuro/http-from-tcp/internal/request"
+    "github.com/mrtuuro/http-from-tcp/internal/response"
+    "github.com/mrtuuro/http-from-tcp/internal/server"
+)
+
+// Serve runs a request for method and target through h, without a
+// connection, and returns the raw response
+func Serve(t *testing.T, h server.Handler, method, target string) string {
+    t.Helper()
+    req, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+    require.NoError(t, err)
+    buf := &bytes.Buffer{}
+    w := response.NewWriter(buf)
+    w.SetKeepAlive(true)
+    w.SetDiscardBody(method == "HEAD")
+    h(w, req)
+    return buf.String()
+}
+
+// Listen serves h on a local listener until the test ends and returns its
+// address
+func Listen(t *testing.T, h server.Handler) string {
+    t.Helper()
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    require.NoError(t, err)
+    s := server.ServeListener(l, h, server.Options{})
+    t.Cleanup(func() { s.Close() })
+    return l.Addr().String()
+}